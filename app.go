@@ -5,8 +5,10 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 
 	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/internal/pkg/journal"
 	"bs2-evt-filter/internal/pkg/ws"
 )
 
@@ -43,12 +45,29 @@ func (app *App) run() {
 	mw := io.MultiWriter(logFile, os.Stdout)
 	log.SetOutput(mw)
 
-	hub := ws.NewHub()
-	hub.UpdateAuth(app.config.Clients.Auth)
+	hub := ws.NewHub(app.config.Server.Replay)
+	hub.UpdateServer(app.config.Server)
+	hub.UpdateClients(app.config.Clients)
+	if jc := app.config.Journal; len(jc.Path) > 0 {
+		path := jc.Path
+		if !filepath.IsAbs(path) {
+			path = appPath(path)
+		}
+		j, err := journal.Open(path, jc.SegmentSize, jc.Retention)
+		if err != nil {
+			log.Fatalf("[main] error opening journal: %v", err)
+		}
+		defer j.Close()
+		hub.SetJournal(j)
+	}
 
+	if err := hub.RegisterMetrics(); err != nil {
+		log.Printf("[main] error registering hub metrics: %v", err)
+	}
 	go hub.Run()
 	server := newServer(app.config, hub)
 	server.start()
+	startOutputs(app.config)
 	go startRemotes(app.config, hub)
 
 	log.Println("[main] starting")
@@ -56,13 +75,17 @@ func (app *App) run() {
 		select {
 		case <-app.reloadC:
 			log.Println("[main] reloading")
-			hub.UpdateAuth(app.config.Clients.Auth)
+			hub.UpdateServer(app.config.Server)
+			hub.UpdateClients(app.config.Clients)
 			server.reload()
+			reloadOutputs(app.config)
 			reloadRemotes(app.config, hub)
+			hub.UpdateRemotes(app.config.Remotes)
 		case <-app.stopC:
 			log.Println("[main] stopping")
 			server.stop()
 			stopRemotes(app.config, hub)
+			stopOutputs()
 			log.Println("[main] finished")
 			return
 		}
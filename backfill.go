@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"bs2-evt-filter/pkg/biostar2"
+)
+
+const backfillPageSize = 100
+
+type backfillMessage struct {
+	Event    json.RawMessage `json:"Event"`
+	Backfill bool            `json:"backfill"`
+}
+
+// backfill fetches events missed while the websocket was down. Session
+// renewals on a live websocket do not backfill.
+func (r *Remote) backfill(bs2api *biostar2.API) {
+	r.lock.Lock()
+	after := r.lastIndex
+	max := r.config.Backfill.Max
+	reconnected := r.reconnected
+	r.reconnected = false
+	r.lock.Unlock()
+	if !reconnected || after == 0 || max <= 0 {
+		return
+	}
+	r.log("backfill events after index %d", after)
+	count := 0
+	for count < max {
+		limit := backfillPageSize
+		if max-count < limit {
+			limit = max - count
+		}
+		rows, err := bs2api.SearchEvents(r.ctx, strconv.FormatUint(after, 10), limit)
+		if err != nil {
+			r.log("backfill failed after index %d: %v", after, err)
+			return
+		}
+		for _, row := range rows {
+			msg, err := json.Marshal(&backfillMessage{Event: row, Backfill: true})
+			if err != nil {
+				continue
+			}
+			e, ok := biostar2.ParseEvent(msg)
+			if !ok {
+				continue
+			}
+			index, err := strconv.ParseUint(e.Index, 10, 64)
+			if err != nil {
+				continue
+			}
+			if index > after {
+				after = index
+			}
+			r.lock.Lock()
+			delivered := index <= r.lastIndex
+			r.lock.Unlock()
+			if delivered {
+				continue
+			}
+			select {
+			case r.recv <- msg:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+		count += len(rows)
+		if len(rows) < limit {
+			break
+		}
+	}
+	r.log("backfilled %d events", count)
+}
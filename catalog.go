@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/pkg/biostar2"
+)
+
+// catalogMaxAge is how long a synced catalog is used before it is fetched
+// again on a session renewal.
+const catalogMaxAge = 24 * time.Hour
+
+func catalogPath(remote string) string {
+	return appPath("event_types." + remote + ".json")
+}
+
+func loadCatalog(remote string) *biostar2.EventTypeCatalog {
+	data, err := ioutil.ReadFile(catalogPath(remote))
+	if err != nil {
+		return nil
+	}
+	var types []biostar2.EventType
+	if err := json.Unmarshal(data, &types); err != nil {
+		return nil
+	}
+	return biostar2.NewEventTypeCatalog(types)
+}
+
+// saveCatalog writes the catalog unless the saved one is the same. It
+// reports whether the catalog changed.
+func saveCatalog(remote string, catalog *biostar2.EventTypeCatalog) (bool, error) {
+	data, err := json.MarshalIndent(catalog.Types(), "", "  ")
+	if err != nil {
+		return false, err
+	}
+	path := catalogPath(remote)
+	if old, err := ioutil.ReadFile(path); err == nil && bytes.Equal(old, data) {
+		return false, nil
+	}
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return true, err
+	}
+	return true, os.Rename(path+".tmp", path)
+}
+
+func resolveEventTypes(codes map[string]string, names map[string]string, catalog *biostar2.EventTypeCatalog, unknown *[]string) map[string]string {
+	if len(names) == 0 {
+		return codes
+	}
+	resolved := make(map[string]string, len(codes))
+	for code, label := range codes {
+		resolved[code] = label
+	}
+	for name, label := range names {
+		var found []string
+		if catalog != nil {
+			found = catalog.Resolve(name)
+		}
+		if len(found) == 0 {
+			*unknown = append(*unknown, name)
+		}
+		for _, code := range found {
+			resolved[code] = label
+		}
+	}
+	return resolved
+}
+
+func resolveFilter(filter config.FilterConf, catalog *biostar2.EventTypeCatalog) (config.FilterConf, []string) {
+	var unknown []string
+	filter.EventTypeCodes = resolveEventTypes(filter.EventTypeCodes, filter.EventTypeNames, catalog, &unknown)
+	filter.Exclude.EventTypeCodes = resolveEventTypes(filter.Exclude.EventTypeCodes, filter.Exclude.EventTypeNames, catalog, &unknown)
+	sort.Strings(unknown)
+	return filter, unknown
+}
+
+func (r *Remote) updateFilter(filter config.FilterConf) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.config.Filter = filter
+	resolved, unknown := resolveFilter(filter, r.catalog)
+	r.filter = resolved
+	if len(unknown) == 0 {
+		return
+	}
+	// names that cannot be resolved match no events, report them in the
+	// status too
+	err := fmt.Errorf("unknown event type names: %s", strings.Join(unknown, ", "))
+	if r.catalog == nil {
+		err = fmt.Errorf("no cached event type catalog, names cannot be resolved until it is synced: %s", strings.Join(unknown, ", "))
+	}
+	r.log("%v", err)
+	r.lastError = err.Error()
+	r.lastErrorAt = time.Now()
+}
+
+// syncEventTypes fetches the catalog once per connection, and on session
+// renewals when it is older than catalogMaxAge.
+func (r *Remote) syncEventTypes(bs2api *biostar2.API) {
+	r.lock.Lock()
+	due := r.catalogSynced.IsZero() || r.reconnected || time.Since(r.catalogSynced) > catalogMaxAge
+	r.lock.Unlock()
+	if !due {
+		return
+	}
+	types, err := bs2api.EventTypes(r.ctx)
+	if err != nil {
+		r.log("event type catalog sync failed: %v", err)
+		return
+	}
+	catalog := biostar2.NewEventTypeCatalog(types)
+	changed, err := saveCatalog(r.name, catalog)
+	if err != nil {
+		r.log("event type catalog save failed: %v", err)
+	}
+	r.lock.Lock()
+	r.catalogSynced = time.Now()
+	if !changed && r.catalog != nil {
+		r.lock.Unlock()
+		r.log("event type catalog unchanged: %d types", len(types))
+		return
+	}
+	r.catalog = catalog
+	filter := r.config.Filter
+	r.lock.Unlock()
+	r.log("event type catalog synced: %d types", len(types))
+	r.updateFilter(filter)
+}
+
+// eventTypeName looks up the name of an event type code in the remote's
+// catalog, for events that arrive without one.
+func eventTypeName(remote string, code string) string {
+	remotesLock.RLock()
+	r, ok := remotes[remote]
+	remotesLock.RUnlock()
+	if !ok {
+		return ""
+	}
+	r.lock.Lock()
+	catalog := r.catalog
+	r.lock.Unlock()
+	if catalog == nil {
+		return ""
+	}
+	return catalog.Name(code)
+}
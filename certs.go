@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"path/filepath"
+	"sync"
+
+	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/internal/pkg/tlsconf"
+	"github.com/fsnotify/fsnotify"
+)
+
+type certWatcher struct {
+	certFile string
+	keyFile  string
+	lock     *sync.RWMutex
+	cert     *tls.Certificate
+	watcher  *fsnotify.Watcher
+	done     chan struct{}
+}
+
+func newCertWatcher(certFile string, keyFile string) (*certWatcher, error) {
+	cw := &certWatcher{
+		certFile: filepath.Clean(certFile),
+		keyFile:  filepath.Clean(keyFile),
+		lock:     new(sync.RWMutex),
+		done:     make(chan struct{}),
+	}
+	if err := cw.load(); err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// watch directories, so that certificates replaced by rename are noticed
+	dirs := map[string]bool{filepath.Dir(cw.certFile): true, filepath.Dir(cw.keyFile): true}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	cw.watcher = watcher
+	go cw.watch()
+	return cw, nil
+}
+
+func (cw *certWatcher) log(f string, v ...interface{}) {
+	log.Printf("[srv.cert] "+f, v...)
+}
+
+func (cw *certWatcher) load() error {
+	cert, err := tls.LoadX509KeyPair(cw.certFile, cw.keyFile)
+	if err != nil {
+		return err
+	}
+	cw.lock.Lock()
+	cw.cert = &cert
+	cw.lock.Unlock()
+	return nil
+}
+
+func (cw *certWatcher) watch() {
+	for {
+		select {
+		case e, ok := <-cw.watcher.Events:
+			if !ok {
+				return
+			}
+			name := filepath.Clean(e.Name)
+			if name != cw.certFile && name != cw.keyFile {
+				continue
+			}
+			if e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if err := cw.load(); err != nil {
+				cw.log("reload failed, keeping current certificate: %v", err)
+				continue
+			}
+			cw.log("certificate reloaded: %s", cw.certFile)
+		case err, ok := <-cw.watcher.Errors:
+			if !ok {
+				return
+			}
+			cw.log("watch error: %v", err)
+		case <-cw.done:
+			return
+		}
+	}
+}
+
+func (cw *certWatcher) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cw.lock.RLock()
+	defer cw.lock.RUnlock()
+	return cw.cert, nil
+}
+
+func (cw *certWatcher) close() {
+	close(cw.done)
+	cw.watcher.Close()
+}
+
+func newTLSConfig(tc config.TLSConf) (*tls.Config, error) {
+	path := func(p string) string {
+		if len(p) == 0 || filepath.IsAbs(p) {
+			return p
+		}
+		return appPath(p)
+	}
+	return tlsconf.New(tlsconf.Options{
+		CAFile:      path(tc.CA),
+		Fingerprint: tc.Fingerprint,
+		ServerName:  tc.ServerName,
+		CertFile:    path(tc.Cert),
+		KeyFile:     path(tc.Key),
+		Insecure:    tc.Insecure,
+	})
+}
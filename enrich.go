@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"bs2-evt-filter/pkg/biostar2"
+)
+
+const (
+	enrichNegativeTTL = time.Minute
+	enrichWorkers     = 4
+	enrichQueueSize   = 256
+	enrichEvictPeriod = time.Minute
+)
+
+type enrichEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// enrichCall is a lookup result. Concurrent misses of the same key share
+// one call; done is nil for cache hits.
+type enrichCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+func (c *enrichCall) wait(ctx context.Context) bool {
+	if c == nil || c.done == nil {
+		return true
+	}
+	select {
+	case <-c.done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// enrichJob is a filtered event waiting for its lookups. Jobs are
+// delivered in the order the events were received.
+type enrichJob struct {
+	event  *biostar2.Event
+	msg    []byte
+	user   *enrichCall
+	device *enrichCall
+	doors  []*enrichCall
+}
+
+type enricher struct {
+	ttl     time.Duration
+	lock    *sync.Mutex
+	cache   map[string]enrichEntry
+	calls   map[string]*enrichCall
+	workers chan struct{}
+}
+
+func newEnricher(ttl time.Duration) *enricher {
+	return &enricher{
+		ttl:     ttl,
+		lock:    new(sync.Mutex),
+		cache:   make(map[string]enrichEntry),
+		calls:   make(map[string]*enrichCall),
+		workers: make(chan struct{}, enrichWorkers),
+	}
+}
+
+// lookup returns the cached value of key, or starts fetching it. At most
+// enrichWorkers fetches run at the same time.
+func (en *enricher) lookup(key string, fetch func() (interface{}, error)) *enrichCall {
+	en.lock.Lock()
+	defer en.lock.Unlock()
+	if entry, ok := en.cache[key]; ok && time.Now().Before(entry.expires) {
+		return &enrichCall{value: entry.value}
+	}
+	if c, ok := en.calls[key]; ok {
+		return c
+	}
+	c := &enrichCall{done: make(chan struct{})}
+	en.calls[key] = c
+	go en.fetch(key, c, fetch)
+	return c
+}
+
+func (en *enricher) fetch(key string, c *enrichCall, fetch func() (interface{}, error)) {
+	en.workers <- struct{}{}
+	c.value, c.err = fetch()
+	<-en.workers
+	ttl := en.ttl
+	if c.err != nil {
+		c.value = nil
+		if ttl > enrichNegativeTTL {
+			ttl = enrichNegativeTTL
+		}
+	}
+	en.lock.Lock()
+	en.cache[key] = enrichEntry{value: c.value, expires: time.Now().Add(ttl)}
+	delete(en.calls, key)
+	en.lock.Unlock()
+	close(c.done)
+}
+
+func (en *enricher) evict() {
+	en.lock.Lock()
+	defer en.lock.Unlock()
+	now := time.Now()
+	for k, v := range en.cache {
+		if now.After(v.expires) {
+			delete(en.cache, k)
+		}
+	}
+}
+
+// enrich starts the lookups for a filtered event and queues it for
+// delivery. The remote filter has already seen the event as received.
+func (r *Remote) enrich(e *biostar2.Event, msg []byte) *enrichJob {
+	job := &enrichJob{event: e, msg: msg}
+	r.lock.Lock()
+	en := r.enricher
+	r.lock.Unlock()
+	if en == nil {
+		return job
+	}
+	bs2api := r.bioStar2
+	if len(e.User.ID) > 0 {
+		id := e.User.ID
+		job.user = en.lookup("user:"+id, func() (interface{}, error) {
+			return bs2api.GetUser(r.ctx, id)
+		})
+	}
+	if len(e.Device.ID) > 0 {
+		id := e.Device.ID
+		job.device = en.lookup("device:"+id, func() (interface{}, error) {
+			return bs2api.GetDevice(r.ctx, id)
+		})
+	}
+	for _, door := range e.Doors {
+		var c *enrichCall
+		if id := door.ID; len(id) > 0 {
+			c = en.lookup("door:"+id, func() (interface{}, error) {
+				return bs2api.GetDoor(r.ctx, id)
+			})
+		}
+		job.doors = append(job.doors, c)
+	}
+	return job
+}
+
+// deliver broadcasts and publishes enriched events in order, evicting
+// expired cache entries on the side.
+func (r *Remote) deliver() {
+	defer r.wait.Done()
+	evict := time.NewTicker(enrichEvictPeriod)
+	defer evict.Stop()
+	for {
+		select {
+		case job := <-r.pending:
+			msg, ok := r.complete(job)
+			if !ok {
+				return
+			}
+			e := job.event
+			if e.Backfill {
+				r.log("filtered backfill event: %v", e)
+			} else {
+				r.log("filtered event: %v", e)
+			}
+			r.hub.Broadcast(r.name, e, msg)
+			publish(r.name, e, msg)
+		case <-evict.C:
+			r.lock.Lock()
+			en := r.enricher
+			r.lock.Unlock()
+			if en != nil {
+				en.evict()
+			}
+		case <-r.ctx.Done():
+			r.log("stopping deliver routine")
+			return
+		}
+	}
+}
+
+// complete waits for the lookups of a job and applies their results.
+func (r *Remote) complete(job *enrichJob) ([]byte, bool) {
+	e := job.event
+	changed := false
+	if job.user.wait(r.ctx) && job.user != nil {
+		if job.user.err != nil {
+			r.log("enrich user %s: %v", e.User.ID, job.user.err)
+		}
+		if u, ok := job.user.value.(*biostar2.UserInfo); ok && u != nil {
+			e.User.Name = u.Name
+			e.User.Department = u.Department
+			changed = true
+		}
+	}
+	if job.device.wait(r.ctx) && job.device != nil {
+		if job.device.err != nil {
+			r.log("enrich device %s: %v", e.Device.ID, job.device.err)
+		}
+		if d, ok := job.device.value.(*biostar2.DeviceInfo); ok && d != nil {
+			e.Device.Name = d.Name
+			changed = true
+		}
+	}
+	for i, c := range job.doors {
+		if !c.wait(r.ctx) || c == nil {
+			continue
+		}
+		if c.err != nil {
+			r.log("enrich door %s: %v", e.Doors[i].ID, c.err)
+		}
+		if d, ok := c.value.(*biostar2.DoorInfo); ok && d != nil {
+			e.Doors[i].Name = d.Name
+			changed = true
+		}
+	}
+	if r.ctx.Err() != nil {
+		return nil, false
+	}
+	if !changed {
+		return job.msg, true
+	}
+	enriched, err := enrichMessage(e, job.msg)
+	if err != nil {
+		r.log("enrich event %s: %v", e.Index, err)
+		return job.msg, true
+	}
+	return enriched, true
+}
+
+func enrichMessage(e *biostar2.Event, msg []byte) ([]byte, error) {
+	var wrapper map[string]json.RawMessage
+	if err := json.Unmarshal(msg, &wrapper); err != nil {
+		return nil, err
+	}
+	var event map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(wrapper["Event"]))
+	d.UseNumber()
+	if err := d.Decode(&event); err != nil {
+		return nil, err
+	}
+	if len(e.User.ID) > 0 {
+		user, _ := event["user_id"].(map[string]interface{})
+		if user == nil {
+			user = map[string]interface{}{"user_id": e.User.ID}
+		}
+		user["name"] = e.User.Name
+		user["department"] = e.User.Department
+		event["user_id"] = user
+	}
+	if device, ok := event["device_id"].(map[string]interface{}); ok {
+		device["name"] = e.Device.Name
+	}
+	switch doors := event["door_id"].(type) {
+	case []interface{}:
+		for i, door := range doors {
+			if d, ok := door.(map[string]interface{}); ok && i < len(e.Doors) {
+				d["name"] = e.Doors[i].Name
+			}
+		}
+	case map[string]interface{}:
+		if len(e.Doors) > 0 {
+			doors["name"] = e.Doors[0].Name
+		}
+	}
+	raw, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	wrapper["Event"] = raw
+	e.Raw = raw
+	return json.Marshal(wrapper)
+}
@@ -6,7 +6,7 @@ import (
 )
 
 func filterEvent(filter *config.FilterConf, e *biostar2.Event) bool {
-	if len(filter.EventTypeCodes) > 0 {
+	if len(filter.EventTypeCodes) > 0 || len(filter.EventTypeNames) > 0 {
 		_, ok := filter.EventTypeCodes[e.EventType.Code]
 		if !ok {
 			return false
@@ -18,5 +18,43 @@ func filterEvent(filter *config.FilterConf, e *biostar2.Event) bool {
 			return false
 		}
 	}
+	if len(filter.UserIDs) > 0 {
+		_, ok := filter.UserIDs[e.User.ID]
+		if !ok {
+			return false
+		}
+	}
+	if len(filter.UserGroupIDs) > 0 {
+		_, ok := filter.UserGroupIDs[e.UserGroup.ID]
+		if !ok {
+			return false
+		}
+	}
+	if len(filter.DoorIDs) > 0 && !matchAny(filter.DoorIDs, e.Doors.IDs()) {
+		return false
+	}
+	if _, ok := filter.Exclude.EventTypeCodes[e.EventType.Code]; ok {
+		return false
+	}
+	if _, ok := filter.Exclude.DeviceIDs[e.Device.ID]; ok {
+		return false
+	}
+	if len(e.User.ID) > 0 {
+		if _, ok := filter.Exclude.UserIDs[e.User.ID]; ok {
+			return false
+		}
+	}
+	if filter.Expr != nil && !filter.Expr.Match(e) {
+		return false
+	}
 	return true
 }
+
+func matchAny(m map[string]string, values []string) bool {
+	for _, v := range values {
+		if _, ok := m[v]; ok {
+			return true
+		}
+	}
+	return false
+}
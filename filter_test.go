@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+
+	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/pkg/biostar2"
+)
+
+var testCatalog = biostar2.NewEventTypeCatalog([]biostar2.EventType{
+	{Code: "4865", Name: "VERIFY_SUCCESS_CARD"},
+	{Code: "4866", Name: "VERIFY_SUCCESS_FINGER"},
+	{Code: "6401", Name: "IDENTIFY_FAIL_CARD"},
+})
+
+func set(keys ...string) map[string]string {
+	m := make(map[string]string, len(keys))
+	for _, k := range keys {
+		m[k] = ""
+	}
+	return m
+}
+
+func TestFilterEvent(t *testing.T) {
+	const (
+		card   = `{"Event":{"index":"1","event_type_id":{"code":"4865"},"device_id":{"id":"541"},"user_id":{"user_id":"7"}}}`
+		finger = `{"Event":{"index":"2","event_type_id":{"code":"4866"},"device_id":{"id":"542"},"user_id":{"user_id":"8"}}}`
+		fail   = `{"Event":{"index":"3","event_type_id":{"code":"6401"},"device_id":{"id":"541"}}}`
+		door   = `{"Event":{"index":"4","event_type_id":{"code":"4865"},"device_id":{"id":"541"},"user_id":{"user_id":"7"},"user_group_id":{"id":"1"},"door_id":{"id":"10"}}}`
+		doors  = `{"Event":{"index":"5","event_type_id":{"code":"4865"},"device_id":{"id":"542"},"user_id":{"user_id":"8"},"user_group_id":{"id":"2"},"door_id":[{"id":"11"},{"id":"12"}]}}`
+	)
+	tests := []struct {
+		name   string
+		filter config.FilterConf
+		event  string
+		want   bool
+	}{
+		{"no filter", config.FilterConf{}, card, true},
+
+		{"allow code", config.FilterConf{EventTypeCodes: set("4865")}, card, true},
+		{"allow code other", config.FilterConf{EventTypeCodes: set("4865")}, finger, false},
+		{"allow name", config.FilterConf{EventTypeNames: set("VERIFY_SUCCESS_*")}, finger, true},
+		{"allow name other", config.FilterConf{EventTypeNames: set("VERIFY_SUCCESS_*")}, fail, false},
+		{"allow unresolved name", config.FilterConf{EventTypeNames: set("NO_SUCH_EVENT")}, card, false},
+		{"allow device", config.FilterConf{DeviceIDs: set("541")}, fail, true},
+		{"allow device other", config.FilterConf{DeviceIDs: set("541")}, finger, false},
+		{"allow code and device", config.FilterConf{EventTypeCodes: set("4865"), DeviceIDs: set("542")}, card, false},
+
+		{"exclude code", config.FilterConf{Exclude: config.ExcludeConf{EventTypeCodes: set("4865")}}, card, false},
+		{"exclude code other", config.FilterConf{Exclude: config.ExcludeConf{EventTypeCodes: set("4865")}}, finger, true},
+		{"exclude name", config.FilterConf{Exclude: config.ExcludeConf{EventTypeNames: set("identify_fail_*")}}, fail, false},
+		{"exclude name other", config.FilterConf{Exclude: config.ExcludeConf{EventTypeNames: set("identify_fail_*")}}, card, true},
+		{"exclude device", config.FilterConf{Exclude: config.ExcludeConf{DeviceIDs: set("541")}}, fail, false},
+		{"exclude user", config.FilterConf{Exclude: config.ExcludeConf{UserIDs: set("7")}}, card, false},
+		{"exclude user other", config.FilterConf{Exclude: config.ExcludeConf{UserIDs: set("7")}}, finger, true},
+
+		{"allow and exclude overlap", config.FilterConf{
+			EventTypeNames: set("VERIFY_SUCCESS_*"),
+			Exclude:        config.ExcludeConf{EventTypeCodes: set("4865")},
+		}, card, false},
+		{"allow and exclude overlap other", config.FilterConf{
+			EventTypeNames: set("VERIFY_SUCCESS_*"),
+			Exclude:        config.ExcludeConf{EventTypeCodes: set("4865")},
+		}, finger, true},
+		{"allow device exclude user", config.FilterConf{
+			DeviceIDs: set("541"),
+			Exclude:   config.ExcludeConf{UserIDs: set("7")},
+		}, card, false},
+
+		{"allow user", config.FilterConf{UserIDs: set("7")}, card, true},
+		{"allow user other", config.FilterConf{UserIDs: set("7")}, finger, false},
+		{"allow user group", config.FilterConf{UserGroupIDs: set("1")}, door, true},
+		{"allow user group other", config.FilterConf{UserGroupIDs: set("1")}, doors, false},
+		{"allow user group missing", config.FilterConf{UserGroupIDs: set("1")}, card, false},
+		{"allow door object", config.FilterConf{DoorIDs: set("10")}, door, true},
+		{"allow door object other", config.FilterConf{DoorIDs: set("11")}, door, false},
+		{"allow door array", config.FilterConf{DoorIDs: set("12")}, doors, true},
+		{"allow door array any", config.FilterConf{DoorIDs: set("10", "11")}, doors, true},
+		{"allow door array other", config.FilterConf{DoorIDs: set("10")}, doors, false},
+		{"allow door missing", config.FilterConf{DoorIDs: set("10")}, card, false},
+		{"allow user and door", config.FilterConf{UserIDs: set("7"), DoorIDs: set("12")}, doors, false},
+		{"allow group and door", config.FilterConf{UserGroupIDs: set("2"), DoorIDs: set("12")}, doors, true},
+
+		{"empty user allowed", config.FilterConf{UserIDs: set("7")}, fail, false},
+		{"empty user excluded", config.FilterConf{Exclude: config.ExcludeConf{UserIDs: set("")}}, fail, true},
+		{"empty user excluded other", config.FilterConf{Exclude: config.ExcludeConf{UserIDs: set("")}}, card, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, ok := biostar2.ParseEvent([]byte(tt.event))
+			if !ok {
+				t.Fatalf("invalid event: %s", tt.event)
+			}
+			filter, _ := resolveFilter(tt.filter, testCatalog)
+			if got := filterEvent(&filter, e); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"bs2-evt-filter/pkg/biostar2"
+)
+
+type gapNotice struct {
+	Gap gap `json:"Gap"`
+}
+
+type gap struct {
+	Remote  string `json:"remote"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Missing uint64 `json:"missing,omitempty"`
+	Reset   bool   `json:"reset,omitempty"`
+}
+
+func (r *Remote) updateIndex(e *biostar2.Event) {
+	if msg := r.checkIndex(e); msg != nil {
+		r.hub.Notify(r.name, msg)
+	}
+}
+
+// checkIndex tracks the event index of the remote, counting gaps and
+// resets. It returns the notice to send to clients, if any.
+func (r *Remote) checkIndex(e *biostar2.Event) []byte {
+	index, err := strconv.ParseUint(e.Index, 10, 64)
+	if err != nil {
+		return nil
+	}
+	r.lock.Lock()
+	last := r.lastIndex
+	notify := r.config.Gap.Notify
+	var g *gap
+	switch {
+	case e.Backfill && index <= last:
+		// backfilled events may interleave with live ones, only live
+		// events can tell that the index was reset
+		r.lock.Unlock()
+		return nil
+	case last == 0 || index == last+1:
+	case index > last+1:
+		r.gaps += index - last - 1
+		eventGaps.Add(float64(index-last-1), r.name)
+		g = &gap{Remote: r.name, From: strconv.FormatUint(last, 10), To: e.Index, Missing: index - last - 1}
+		r.log("event gap: %d missing between index %d and %d (total missing: %d)", g.Missing, last, index, r.gaps)
+	case index == last:
+		r.log("duplicate event index %d", index)
+	default:
+		r.resets++
+		eventIndexResets.Inc(r.name)
+		g = &gap{Remote: r.name, From: strconv.FormatUint(last, 10), To: e.Index, Reset: true}
+		r.log("event index went backwards from %d to %d (total resets: %d)", last, index, r.resets)
+	}
+	r.lastIndex = index
+	r.lock.Unlock()
+
+	if g == nil || !notify {
+		return nil
+	}
+	msg, err := json.Marshal(&gapNotice{*g})
+	if err != nil {
+		return nil
+	}
+	return msg
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/pkg/biostar2"
+)
+
+func TestCheckIndex(t *testing.T) {
+	tests := []struct {
+		name string
+		// events are event indexes, prefixed with b when backfilled
+		events      []string
+		notify      bool
+		wantGaps    uint64
+		wantResets  uint64
+		wantLast    uint64
+		wantNotices []string
+	}{
+		{"sequential", []string{"1", "2", "3"}, true, 0, 0, 3, nil},
+		{"first index", []string{"100", "101"}, true, 0, 0, 101, nil},
+		{"gap", []string{"1", "2", "5"}, true, 2, 0, 5, []string{
+			`{"Gap":{"remote":"local","from":"2","to":"5","missing":2}}`,
+		}},
+		{"gap without notify", []string{"1", "2", "5"}, false, 2, 0, 5, nil},
+		{"gaps", []string{"1", "3", "6"}, true, 3, 0, 6, []string{
+			`{"Gap":{"remote":"local","from":"1","to":"3","missing":1}}`,
+			`{"Gap":{"remote":"local","from":"3","to":"6","missing":2}}`,
+		}},
+		{"duplicate", []string{"1", "2", "2", "3"}, true, 0, 0, 3, nil},
+		{"reset", []string{"5", "6", "1", "2"}, true, 0, 1, 2, []string{
+			`{"Gap":{"remote":"local","from":"6","to":"1","reset":true}}`,
+		}},
+		{"reset without notify", []string{"5", "6", "1"}, false, 0, 1, 1, nil},
+		{"backfill below last", []string{"5", "6", "b3", "b4", "b6", "7"}, true, 0, 0, 7, nil},
+		{"backfill above last", []string{"5", "b6", "b7", "8"}, true, 0, 0, 8, nil},
+		{"backfill gap", []string{"5", "b8"}, true, 2, 0, 8, []string{
+			`{"Gap":{"remote":"local","from":"5","to":"8","missing":2}}`,
+		}},
+		{"invalid index", []string{"1", "x", "2"}, true, 0, 0, 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Remote{
+				name:   "local",
+				config: config.RemoteConf{Gap: config.GapConf{Notify: tt.notify}},
+				lock:   new(sync.Mutex),
+			}
+			gaps := eventGaps.Value(r.name)
+			resets := eventIndexResets.Value(r.name)
+			var notices []string
+			for _, index := range tt.events {
+				e := &biostar2.Event{Index: strings.TrimPrefix(index, "b"), Backfill: strings.HasPrefix(index, "b")}
+				if msg := r.checkIndex(e); msg != nil {
+					notices = append(notices, string(msg))
+				}
+			}
+			if r.gaps != tt.wantGaps || r.resets != tt.wantResets || r.lastIndex != tt.wantLast {
+				t.Errorf("got %d gaps, %d resets, last %d, want %d gaps, %d resets, last %d",
+					r.gaps, r.resets, r.lastIndex, tt.wantGaps, tt.wantResets, tt.wantLast)
+			}
+			if n := eventGaps.Value(r.name) - gaps; n != float64(tt.wantGaps) {
+				t.Errorf("counted %v missing events, want %d", n, tt.wantGaps)
+			}
+			if n := eventIndexResets.Value(r.name) - resets; n != float64(tt.wantResets) {
+				t.Errorf("counted %v resets, want %d", n, tt.wantResets)
+			}
+			if !reflect.DeepEqual(notices, tt.wantNotices) {
+				t.Errorf("got notices %v, want %v", notices, tt.wantNotices)
+			}
+		})
+	}
+}
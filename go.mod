@@ -2,6 +2,7 @@ module bs2-evt-filter
 
 require (
 	github.com/BurntSushi/toml v0.3.1 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.1.1
 	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gorilla/websocket v1.4.0
 	github.com/kr/pretty v0.1.0 // indirect
@@ -9,6 +10,8 @@ require (
 	github.com/spf13/cast v1.3.0 // indirect
 	github.com/spf13/pflag v1.0.3 // indirect
 	github.com/spf13/viper v1.2.1
-	golang.org/x/sys v0.0.0-20181107165924-66b7b1311ac8
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+	golang.org/x/net v0.0.0-20190311183353-d8887717615a // indirect
+	golang.org/x/sys v0.0.0-20190215142949-d0b11bdaac8a
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 )
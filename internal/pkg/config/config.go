@@ -1,11 +1,15 @@
 package config
 
 import (
+	"fmt"
 	"log"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"bs2-evt-filter/pkg/expr"
+	"bs2-evt-filter/pkg/secret"
 	"bs2-evt-filter/pkg/sstr"
 	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
@@ -15,15 +19,49 @@ const (
 	defaultRetryHttp      = 15
 	defaultRetryWebSocket = 15
 	defaultRetrySession   = 10 * 60
+	defaultTimeout        = 7
+	defaultServerCert     = "server.crt"
+	defaultServerKey      = "server.key"
+	defaultReplay         = 256
+	defaultAuthTimeout    = 10
+	defaultAuthFailures   = 5
+	defaultAuthLockout    = 5 * 60
+	defaultSegmentSize    = 16
+	defaultRetention      = 16
+	defaultBackfillMax    = 1000
+	defaultEnrichTTL      = 5 * 60
+
+	defaultWebhookHeader       = "X-Signature"
+	defaultWebhookConcurrency  = 4
+	defaultWebhookRetryInitial = 1
+	defaultWebhookRetryMax     = 5 * 60
+	defaultWebhookQueueSize    = 1000
+
+	defaultMQTTTopic     = "bs2/{remote}/{device.id}/{event_type.code}"
+	defaultMQTTQueueSize = 1000
+
+	defaultSyslogNetwork   = "udp"
+	defaultSyslogFormat    = "cef"
+	defaultSyslogFacility  = "local0"
+	defaultSyslogAppName   = "bs2-evt-filter"
+	defaultSyslogSeverity  = 3
+	defaultSyslogQueueSize = 1000
 )
 
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
 func NewConfig(path string, name string) *Config {
 	return &Config{
 		path:       path,
 		name:       name,
 		lock:       new(sync.Mutex),
 		OnReload:   nil,
-		lastReload: time.Now().Add(time.Second * -5),
+		lastChange: time.Now().Add(time.Second * -5),
 	}
 }
 
@@ -32,7 +70,7 @@ func (c *Config) Read() {
 	viper.AddConfigPath(c.path)
 	viper.WatchConfig()
 	viper.OnConfigChange(func(e fsnotify.Event) {
-		if time.Now().Sub(c.lastReload) < time.Second*1 {
+		if time.Now().Sub(c.lastChange) < time.Second*1 {
 			return
 		}
 		log.Println("[config] file changed:", e.Name)
@@ -47,6 +85,21 @@ func (c *Config) Read() {
 	c.reload()
 }
 
+// LastReload returns when the configuration was last applied.
+func (c *Config) LastReload() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lastReload
+}
+
+// LastError returns the error of the last rejected reload and when it
+// happened.
+func (c *Config) LastError() (string, time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lastError, c.lastErrorAt
+}
+
 func (c *Config) readMap(name string) map[string]string {
 	m := make(map[string]string)
 	for k, v := range viper.GetStringMapString(name) {
@@ -59,8 +112,287 @@ func (c *Config) readMap(name string) map[string]string {
 
 }
 
+func (c *Config) readEventTypes(name string) (map[string]string, map[string]string) {
+	codes := make(map[string]string)
+	names := make(map[string]string)
+	for v, k := range c.readMap(name) {
+		v = strings.TrimSpace(v)
+		if _, err := strconv.ParseUint(v, 10, 32); err == nil {
+			codes[v] = k
+		} else {
+			names[strings.ToUpper(v)] = k
+		}
+	}
+	return codes, names
+}
+
+func (c *Config) readSet(name string) map[string]bool {
+	m := make(map[string]bool)
+	for _, v := range viper.GetStringSlice(name) {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		m[v] = true
+	}
+	return m
+}
+
+func (c *Config) readTLS(name string) TLSConf {
+	tls := new(TLSConf)
+	tls.CA = strings.TrimSpace(viper.GetString(name + ".ca"))
+	tls.Fingerprint = strings.TrimSpace(viper.GetString(name + ".fingerprint"))
+	tls.ServerName = strings.TrimSpace(viper.GetString(name + ".server_name"))
+	tls.Cert = strings.TrimSpace(viper.GetString(name + ".cert"))
+	tls.Key = strings.TrimSpace(viper.GetString(name + ".key"))
+	tls.Insecure = viper.GetBool(name + ".insecure")
+	return *tls
+}
+
+func (c *Config) readSecret(name string) string {
+	v := strings.TrimSpace(viper.GetString(name))
+	if sstr.IsProtected(v) {
+		nv, err := sstr.UnprotectString(strings.ToLower(v))
+		if err == nil {
+			v = nv
+		}
+	}
+	return v
+}
+
+func (c *Config) readExpr(name string) (*expr.Expr, error) {
+	s := strings.TrimSpace(viper.GetString(name))
+	if len(s) == 0 {
+		return nil, nil
+	}
+	return expr.Compile(s)
+}
+
+func (c *Config) readWebhooks() (map[string]WebhookConf, error) {
+	webhooks := make(map[string]WebhookConf)
+	for name := range viper.GetStringMap("webhook") {
+		key := "webhook." + name
+		webhook := new(WebhookConf)
+		webhook.Url = strings.TrimSpace(viper.GetString(key + ".url"))
+		if len(webhook.Url) == 0 {
+			continue
+		}
+		webhook.Secret = c.readSecret(key + ".secret")
+		webhook.Header = strings.TrimSpace(viper.GetString(key + ".signature_header"))
+		if len(webhook.Header) == 0 {
+			webhook.Header = defaultWebhookHeader
+		}
+		webhook.Timeout = viper.GetInt(key + ".timeout")
+		if webhook.Timeout <= 0 {
+			webhook.Timeout = defaultTimeout
+		}
+		webhook.Concurrency = viper.GetInt(key + ".concurrency")
+		if webhook.Concurrency <= 0 {
+			webhook.Concurrency = defaultWebhookConcurrency
+		}
+		webhook.Remotes = c.readSet(key + ".remotes")
+		e, err := c.readExpr(key + ".filter.expr")
+		if err != nil {
+			return nil, fmt.Errorf("%s.filter.expr: %v", key, err)
+		}
+		webhook.Filter = e
+		webhook.TLS = c.readTLS(key + ".tls")
+
+		retry := new(WebhookRetryConf)
+		retry.Initial = viper.GetInt(key + ".retry.initial")
+		if retry.Initial <= 0 {
+			retry.Initial = defaultWebhookRetryInitial
+		}
+		retry.Max = viper.GetInt(key + ".retry.max")
+		if retry.Max < retry.Initial {
+			retry.Max = defaultWebhookRetryMax
+		}
+		retry.Attempts = viper.GetInt(key + ".retry.attempts")
+		webhook.Retry = *retry
+
+		queue := new(WebhookQueueConf)
+		queue.Path = strings.TrimSpace(viper.GetString(key + ".queue.path"))
+		queue.Size = viper.GetInt(key + ".queue.size")
+		if queue.Size <= 0 {
+			queue.Size = defaultWebhookQueueSize
+		}
+		webhook.Queue = *queue
+
+		webhooks[name] = *webhook
+	}
+	return webhooks, nil
+}
+
+func (c *Config) readMQTT() (map[string]MQTTConf, error) {
+	brokers := make(map[string]MQTTConf)
+	for name := range viper.GetStringMap("mqtt") {
+		key := "mqtt." + name
+		mqtt := new(MQTTConf)
+		mqtt.Broker = strings.TrimSpace(viper.GetString(key + ".broker"))
+		if len(mqtt.Broker) == 0 {
+			continue
+		}
+		mqtt.ClientID = strings.TrimSpace(viper.GetString(key + ".client_id"))
+		if len(mqtt.ClientID) == 0 {
+			mqtt.ClientID = "bs2-evt-filter-" + name
+		}
+		mqtt.Username = strings.TrimSpace(viper.GetString(key + ".username"))
+		mqtt.Password = c.readSecret(key + ".password")
+		mqtt.Topic = strings.TrimSpace(viper.GetString(key + ".topic"))
+		if len(mqtt.Topic) == 0 {
+			mqtt.Topic = defaultMQTTTopic
+		}
+		mqtt.QoS = viper.GetInt(key + ".qos")
+		if mqtt.QoS < 0 || mqtt.QoS > 2 {
+			log.Printf("[config] %s.qos: must be 0, 1 or 2\n", key)
+			continue
+		}
+		mqtt.Retain = viper.GetBool(key + ".retain")
+		mqtt.Timeout = viper.GetInt(key + ".timeout")
+		if mqtt.Timeout <= 0 {
+			mqtt.Timeout = defaultTimeout
+		}
+		mqtt.Retry = viper.GetInt(key + ".retry")
+		if mqtt.Retry <= 0 {
+			mqtt.Retry = defaultRetryWebSocket
+		}
+		mqtt.QueueSize = viper.GetInt(key + ".queue_size")
+		if mqtt.QueueSize <= 0 {
+			mqtt.QueueSize = defaultMQTTQueueSize
+		}
+		mqtt.Remotes = c.readSet(key + ".remotes")
+		e, err := c.readExpr(key + ".filter.expr")
+		if err != nil {
+			return nil, fmt.Errorf("%s.filter.expr: %v", key, err)
+		}
+		mqtt.Filter = e
+		mqtt.TLS = c.readTLS(key + ".tls")
+		brokers[name] = *mqtt
+	}
+	return brokers, nil
+}
+
+func (c *Config) readSeverity(name string) SeverityConf {
+	severity := new(SeverityConf)
+	severity.Default = defaultSyslogSeverity
+	if viper.IsSet(name + "_default") {
+		severity.Default = viper.GetInt(name + "_default")
+	}
+	severity.Codes = make(map[string]int)
+	severity.Names = make(map[string]int)
+	for k := range viper.GetStringMap(name) {
+		v := viper.GetInt(name + "." + k)
+		if v < 0 || v > 10 {
+			log.Printf("[config] %s.%s: severity must be between 0 and 10\n", name, k)
+			continue
+		}
+		if _, err := strconv.Atoi(k); err == nil {
+			severity.Codes[k] = v
+		} else {
+			severity.Names[strings.ToUpper(k)] = v
+		}
+	}
+	return *severity
+}
+
+func (c *Config) readSyslog() (map[string]SyslogConf, error) {
+	sinks := make(map[string]SyslogConf)
+	for name := range viper.GetStringMap("syslog") {
+		key := "syslog." + name
+		sl := new(SyslogConf)
+		sl.Address = strings.TrimSpace(viper.GetString(key + ".address"))
+		if len(sl.Address) == 0 {
+			continue
+		}
+		sl.Network = strings.ToLower(strings.TrimSpace(viper.GetString(key + ".network")))
+		if len(sl.Network) == 0 {
+			sl.Network = defaultSyslogNetwork
+		}
+		if sl.Network != "udp" && sl.Network != "tcp" && sl.Network != "tls" {
+			log.Printf("[config] %s.network: must be udp, tcp or tls\n", key)
+			continue
+		}
+		sl.Framing = strings.ToLower(strings.TrimSpace(viper.GetString(key + ".framing")))
+		if len(sl.Framing) == 0 {
+			sl.Framing = "octet"
+		}
+		if sl.Framing != "octet" && sl.Framing != "newline" {
+			log.Printf("[config] %s.framing: must be octet or newline\n", key)
+			continue
+		}
+		sl.Format = strings.ToLower(strings.TrimSpace(viper.GetString(key + ".format")))
+		if len(sl.Format) == 0 {
+			sl.Format = defaultSyslogFormat
+		}
+		if sl.Format != "cef" && sl.Format != "leef" {
+			log.Printf("[config] %s.format: must be cef or leef\n", key)
+			continue
+		}
+		facility := strings.ToLower(strings.TrimSpace(viper.GetString(key + ".facility")))
+		if len(facility) == 0 {
+			facility = defaultSyslogFacility
+		}
+		f, ok := syslogFacilities[facility]
+		if !ok {
+			n, err := strconv.Atoi(facility)
+			if err != nil || n < 0 || n > 23 {
+				log.Printf("[config] %s.facility: unknown facility %s\n", key, facility)
+				continue
+			}
+			f = n
+		}
+		sl.Facility = f
+		sl.Hostname = strings.TrimSpace(viper.GetString(key + ".hostname"))
+		sl.AppName = strings.TrimSpace(viper.GetString(key + ".app_name"))
+		if len(sl.AppName) == 0 {
+			sl.AppName = defaultSyslogAppName
+		}
+		sl.Severity = c.readSeverity(key + ".severity")
+		sl.Timeout = viper.GetInt(key + ".timeout")
+		if sl.Timeout <= 0 {
+			sl.Timeout = defaultTimeout
+		}
+		sl.Retry = viper.GetInt(key + ".retry")
+		if sl.Retry <= 0 {
+			sl.Retry = defaultRetryWebSocket
+		}
+		sl.QueueSize = viper.GetInt(key + ".queue_size")
+		if sl.QueueSize <= 0 {
+			sl.QueueSize = defaultSyslogQueueSize
+		}
+		sl.Remotes = c.readSet(key + ".remotes")
+		e, err := c.readExpr(key + ".filter.expr")
+		if err != nil {
+			return nil, fmt.Errorf("%s.filter.expr: %v", key, err)
+		}
+		sl.Filter = e
+		sl.TLS = c.readTLS(key + ".tls")
+		sinks[name] = *sl
+	}
+	return sinks, nil
+}
+
+// reload reads the configuration. If it is invalid, the previous one is
+// kept; an invalid configuration at startup is fatal.
 func (c *Config) reload() {
-	c.lastReload = time.Now()
+	c.lastChange = time.Now()
+	if err := c.load(); err != nil {
+		if !c.loaded {
+			log.Fatalf("[config] error reading: %v\n", err)
+		}
+		log.Printf("[config] reload rejected, keeping the previous configuration: %v\n", err)
+		c.lastError = err.Error()
+		c.lastErrorAt = c.lastChange
+		return
+	}
+	c.loaded = true
+	c.lastReload = c.lastChange
+	if c.OnReload != nil {
+		c.OnReload()
+	}
+}
+
+func (c *Config) load() error {
 
 	svc := new(ServiceConf)
 	svc.Name = viper.GetString("service.name")
@@ -68,25 +400,88 @@ func (c *Config) reload() {
 	if len(svc.Display) == 0 {
 		svc.Display = svc.Name
 	}
-	c.Service = *svc
 
 	srv := new(ServerConf)
 	srv.Port = viper.GetInt("server.port")
-	c.Server = *srv
+	srv.Cert = strings.TrimSpace(viper.GetString("server.cert"))
+	if len(srv.Cert) == 0 {
+		srv.Cert = defaultServerCert
+	}
+	srv.Key = strings.TrimSpace(viper.GetString("server.key"))
+	if len(srv.Key) == 0 {
+		srv.Key = defaultServerKey
+	}
+	srv.Replay = defaultReplay
+	if viper.IsSet("server.replay") {
+		srv.Replay = viper.GetInt("server.replay")
+	}
+	if srv.Replay < 0 {
+		srv.Replay = 0
+	}
+	srv.AuthTimeout = defaultAuthTimeout
+	if viper.IsSet("server.auth_timeout") {
+		srv.AuthTimeout = viper.GetInt("server.auth_timeout")
+	}
+	srv.AuthMaxFailures = defaultAuthFailures
+	if viper.IsSet("server.auth_max_failures") {
+		srv.AuthMaxFailures = viper.GetInt("server.auth_max_failures")
+	}
+	srv.ClientCA = strings.TrimSpace(viper.GetString("server.client_ca"))
+	srv.RequireCert = viper.GetBool("server.require_cert")
+	srv.AuthLockout = viper.GetInt("server.auth_lockout")
+	if srv.AuthLockout <= 0 {
+		srv.AuthLockout = defaultAuthLockout
+	}
+
+	journal := new(JournalConf)
+	journal.Path = strings.TrimSpace(viper.GetString("journal.path"))
+	journal.SegmentSize = viper.GetInt64("journal.segment_size")
+	journal.Retention = viper.GetInt("journal.retention")
+	if journal.SegmentSize <= 0 {
+		journal.SegmentSize = defaultSegmentSize
+	}
+	journal.SegmentSize *= 1024 * 1024
+	if journal.Retention <= 0 {
+		journal.Retention = defaultRetention
+	}
 
 	clients := new(ClientsConf)
 	auth := make(map[string]string)
-	for k, v := range viper.GetStringMapString("clients") {
+	certs := make(map[string]string)
+	acls := make(map[string]ACLConf)
+	for k, cv := range viper.GetStringMap("clients") {
+		var v string
+		if _, ok := cv.(map[string]interface{}); ok {
+			v = viper.GetString("clients." + k + ".password")
+			acl := new(ACLConf)
+			acl.Remotes = c.readSet("clients." + k + ".remotes")
+			acl.EventTypeCodes = c.readSet("clients." + k + ".event_types")
+			acls[k] = *acl
+			for cn := range c.readSet("clients." + k + ".cert_names") {
+				certs[cn] = k
+			}
+		} else {
+			v = viper.GetString("clients." + k)
+		}
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
 		if sstr.IsProtected(v) {
 			nv, err := sstr.UnprotectString(strings.ToLower(v))
 			if err == nil {
 				v = nv
 			}
 		}
+		if secret.IsHashed(v) && secret.Compare(v, "") {
+			log.Printf("[config] clients.%s: secret is a hash of an empty string, ignored\n", k)
+			continue
+		}
 		auth[v] = k
 	}
 	clients.Auth = auth
-	c.Clients = *clients
+	clients.Certs = certs
+	clients.ACL = acls
 
 	remotes := make(map[string]RemoteConf)
 	for name := range viper.AllSettings() {
@@ -96,6 +491,14 @@ func (c *Config) reload() {
 		case "server":
 			fallthrough
 		case "clients":
+			fallthrough
+		case "journal":
+			fallthrough
+		case "webhook":
+			fallthrough
+		case "mqtt":
+			fallthrough
+		case "syslog":
 			continue
 		}
 		remote := new(RemoteConf)
@@ -103,17 +506,18 @@ func (c *Config) reload() {
 		bs2c := new(BioStar2Conf)
 		bs2c.Url = strings.TrimSpace(viper.GetString(name + ".biostar2.url"))
 		bs2c.Username = strings.TrimSpace(viper.GetString(name + ".biostar2.username"))
-		password := strings.TrimSpace(viper.GetString(name + ".biostar2.password"))
-		if sstr.IsProtected(password) {
-			np, err := sstr.UnprotectString(strings.ToLower(password))
-			if err == nil {
-				password = np
-			}
-		}
-		bs2c.Password = password
+		bs2c.Password = c.readSecret(name + ".biostar2.password")
 		if len(bs2c.Url) == 0 || len(bs2c.Username) == 0 || len(bs2c.Password) == 0 {
 			continue
 		}
+		bs2c.Timeout = viper.GetInt(name + ".biostar2.timeout")
+		if bs2c.Timeout <= 0 {
+			bs2c.Timeout = defaultTimeout
+		}
+		bs2c.UserAgent = strings.TrimSpace(viper.GetString(name + ".biostar2.user_agent"))
+		bs2c.Proxy = strings.TrimSpace(viper.GetString(name + ".biostar2.proxy"))
+
+		bs2c.TLS = c.readTLS(name + ".biostar2.tls")
 		remote.BioStar2 = *bs2c
 
 		retry := new(RetryConf)
@@ -131,17 +535,65 @@ func (c *Config) reload() {
 		}
 		remote.Retry = *retry
 
+		backfill := new(BackfillConf)
+		backfill.Max = defaultBackfillMax
+		if viper.IsSet(name + ".backfill.max") {
+			backfill.Max = viper.GetInt(name + ".backfill.max")
+		}
+		remote.Backfill = *backfill
+
+		gap := new(GapConf)
+		gap.Notify = viper.GetBool(name + ".gap.notify")
+		remote.Gap = *gap
+
+		enrich := new(EnrichConf)
+		enrich.Enabled = viper.GetBool(name + ".enrich.enabled")
+		enrich.TTL = viper.GetInt(name + ".enrich.ttl")
+		if enrich.TTL <= 0 {
+			enrich.TTL = defaultEnrichTTL
+		}
+		remote.Enrich = *enrich
+
 		filter := new(FilterConf)
-		filter.EventTypeCodes = c.readMap(name + ".filter.event_type_code")
+		filter.EventTypeCodes, filter.EventTypeNames = c.readEventTypes(name + ".filter.event_type_code")
 		filter.DeviceIDs = c.readMap(name + ".filter.device_id")
+		filter.UserIDs = c.readMap(name + ".filter.user_id")
+		filter.UserGroupIDs = c.readMap(name + ".filter.user_group_id")
+		filter.DoorIDs = c.readMap(name + ".filter.door_id")
+		exclude := new(ExcludeConf)
+		exclude.EventTypeCodes, exclude.EventTypeNames = c.readEventTypes(name + ".filter.exclude.event_type_code")
+		exclude.DeviceIDs = c.readMap(name + ".filter.exclude.device_id")
+		exclude.UserIDs = c.readMap(name + ".filter.exclude.user_id")
+		filter.Exclude = *exclude
+		e, err := c.readExpr(name + ".filter.expr")
+		if err != nil {
+			return fmt.Errorf("%s.filter.expr: %v", name, err)
+		}
+		filter.Expr = e
 		remote.Filter = *filter
 
 		remotes[name] = *remote
 	}
-	c.Remotes = remotes
-
-	if c.OnReload != nil {
-		c.OnReload()
+	webhooks, err := c.readWebhooks()
+	if err != nil {
+		return err
+	}
+	brokers, err := c.readMQTT()
+	if err != nil {
+		return err
+	}
+	sinks, err := c.readSyslog()
+	if err != nil {
+		return err
 	}
 
+	c.Service = *svc
+	c.Server = *srv
+	c.Journal = *journal
+	c.Clients = *clients
+	c.Remotes = remotes
+	c.Webhooks = webhooks
+	c.MQTT = brokers
+	c.Syslog = sinks
+	return nil
 }
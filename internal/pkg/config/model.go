@@ -3,6 +3,8 @@ package config
 import (
 	"sync"
 	"time"
+
+	"bs2-evt-filter/pkg/expr"
 )
 
 type Config struct {
@@ -10,12 +12,22 @@ type Config struct {
 	name       string
 	lock       *sync.Mutex
 	OnReload   func()
+	lastChange time.Time
 	lastReload time.Time
+	loaded     bool
+
+	lastError   string
+	lastErrorAt time.Time
 
 	Service ServiceConf
 	Server  ServerConf
 	Clients ClientsConf
+	Journal JournalConf
 	Remotes map[string]RemoteConf
+
+	Webhooks map[string]WebhookConf
+	MQTT     map[string]MQTTConf
+	Syslog   map[string]SyslogConf
 }
 
 type ServiceConf struct {
@@ -24,23 +36,60 @@ type ServiceConf struct {
 }
 
 type ServerConf struct {
-	Port int
+	Port            int
+	Cert            string
+	Key             string
+	Replay          int
+	AuthTimeout     int
+	AuthMaxFailures int
+	AuthLockout     int
+	ClientCA        string
+	RequireCert     bool
+}
+
+type JournalConf struct {
+	Path        string
+	SegmentSize int64
+	Retention   int
 }
 
 type ClientsConf struct {
-	Auth map[string]string
+	Auth  map[string]string
+	Certs map[string]string
+	ACL   map[string]ACLConf
+}
+
+type ACLConf struct {
+	Remotes        map[string]bool
+	EventTypeCodes map[string]bool
 }
 
 type RemoteConf struct {
 	BioStar2 BioStar2Conf
 	Retry    RetryConf
+	Backfill BackfillConf
+	Gap      GapConf
+	Enrich   EnrichConf
 	Filter   FilterConf
 }
 
 type BioStar2Conf struct {
-	Url      string
-	Username string
-	Password string
+	Url       string
+	Username  string
+	Password  string
+	Timeout   int
+	UserAgent string
+	Proxy     string
+	TLS       TLSConf
+}
+
+type TLSConf struct {
+	CA          string
+	Fingerprint string
+	ServerName  string
+	Cert        string
+	Key         string
+	Insecure    bool
 }
 
 type RetryConf struct {
@@ -49,7 +98,98 @@ type RetryConf struct {
 	Session   int
 }
 
+type BackfillConf struct {
+	Max int
+}
+
+type GapConf struct {
+	Notify bool
+}
+
+type EnrichConf struct {
+	Enabled bool
+	TTL     int
+}
+
 type FilterConf struct {
 	EventTypeCodes map[string]string
+	EventTypeNames map[string]string
 	DeviceIDs      map[string]string
+	UserIDs        map[string]string
+	UserGroupIDs   map[string]string
+	DoorIDs        map[string]string
+	Exclude        ExcludeConf
+	Expr           *expr.Expr
+}
+
+type ExcludeConf struct {
+	EventTypeCodes map[string]string
+	EventTypeNames map[string]string
+	DeviceIDs      map[string]string
+	UserIDs        map[string]string
+}
+
+type WebhookConf struct {
+	Url         string
+	Secret      string
+	Header      string
+	Timeout     int
+	Concurrency int
+	Remotes     map[string]bool
+	Filter      *expr.Expr
+	TLS         TLSConf
+	Retry       WebhookRetryConf
+	Queue       WebhookQueueConf
+}
+
+type WebhookRetryConf struct {
+	Initial  int
+	Max      int
+	Attempts int
+}
+
+type WebhookQueueConf struct {
+	Path string
+	Size int
+}
+
+type MQTTConf struct {
+	Broker    string
+	ClientID  string
+	Username  string
+	Password  string
+	Topic     string
+	QoS       int
+	Retain    bool
+	Timeout   int
+	Retry     int
+	QueueSize int
+	Remotes   map[string]bool
+	Filter    *expr.Expr
+	TLS       TLSConf
+}
+
+type SyslogConf struct {
+	Address   string
+	Network   string
+	Framing   string
+	Format    string
+	Facility  int
+	Hostname  string
+	AppName   string
+	Severity  SeverityConf
+	Timeout   int
+	Retry     int
+	QueueSize int
+	Remotes   map[string]bool
+	Filter    *expr.Expr
+	TLS       TLSConf
+}
+
+// SeverityConf maps event type codes and name patterns to a CEF severity
+// between 0 and 10.
+type SeverityConf struct {
+	Default int
+	Codes   map[string]int
+	Names   map[string]int
 }
@@ -0,0 +1,348 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentExt  = ".log"
+	cursorsFile = "cursors.json"
+)
+
+type Record struct {
+	Seq    uint64          `json:"seq"`
+	Remote string          `json:"remote"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type segment struct {
+	first uint64
+	path  string
+}
+
+type Journal struct {
+	dir         string
+	segmentSize int64
+	retention   int
+	lock        *sync.Mutex
+
+	seq      uint64
+	segments []segment
+	file     *os.File
+	size     int64
+
+	cursors map[string]uint64
+	dirty   bool
+	written bool
+}
+
+func Open(dir string, segmentSize int64, retention int) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		dir:         dir,
+		segmentSize: segmentSize,
+		retention:   retention,
+		lock:        new(sync.Mutex),
+		cursors:     make(map[string]uint64),
+	}
+	if err := j.loadSegments(); err != nil {
+		return nil, err
+	}
+	if err := j.loadCursors(); err != nil {
+		return nil, err
+	}
+	if len(j.segments) == 0 {
+		if err := j.rotate(); err != nil {
+			return nil, err
+		}
+		return j, nil
+	}
+	last := j.segments[len(j.segments)-1]
+	end, err := scanSegment(last.path, 0, func(r *Record, end int64) bool {
+		j.seq = r.Seq
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if j.seq == 0 {
+		j.seq = last.first - 1
+	}
+	f, err := os.OpenFile(last.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// drop a partial record left by an interrupted write, so the next
+	// record does not get appended to it
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, err
+	}
+	j.file = f
+	j.size = end
+	return j, nil
+}
+
+func (j *Journal) loadSegments() error {
+	files, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		j.segments = append(j.segments, segment{first: first, path: filepath.Join(j.dir, name)})
+	}
+	sort.Slice(j.segments, func(a, b int) bool {
+		return j.segments[a].first < j.segments[b].first
+	})
+	return nil
+}
+
+func (j *Journal) loadCursors() error {
+	data, err := ioutil.ReadFile(filepath.Join(j.dir, cursorsFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &j.cursors)
+}
+
+func (j *Journal) rotate() error {
+	if j.file != nil {
+		if err := j.file.Close(); err != nil {
+			return err
+		}
+		j.file = nil
+	}
+	first := j.seq + 1
+	path := filepath.Join(j.dir, fmt.Sprintf("%020d%s", first, segmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	j.file = f
+	j.size = 0
+	j.segments = append(j.segments, segment{first: first, path: path})
+	for j.retention > 0 && len(j.segments) > j.retention {
+		if err := os.Remove(j.segments[0].path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		j.segments = j.segments[1:]
+	}
+	return nil
+}
+
+func (j *Journal) Append(remote string, data []byte) (uint64, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.segmentSize > 0 && j.size >= j.segmentSize {
+		if err := j.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	r := &Record{Seq: j.seq + 1, Remote: remote, Data: data}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return 0, err
+	}
+	line = append(line, '\n')
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	j.seq = r.Seq
+	j.written = true
+	return r.Seq, nil
+}
+
+func (j *Journal) Seq() uint64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.seq
+}
+
+// Reader reads records in order. It keeps its position in the segment
+// files, so every read continues where the previous one stopped.
+type Reader struct {
+	j       *Journal
+	after   uint64
+	first   uint64
+	offset  int64
+	skipped uint64
+}
+
+func (j *Journal) NewReader(after uint64) *Reader {
+	return &Reader{j: j, after: after}
+}
+
+// position finds the segment to continue from, starting over if the
+// current one was removed by retention.
+func (r *Reader) position(segments []segment) int {
+	for i, s := range segments {
+		if r.first > 0 && s.first == r.first {
+			return i
+		}
+	}
+	i := 0
+	for i+1 < len(segments) && segments[i+1].first <= r.after+1 {
+		i++
+	}
+	r.first = segments[i].first
+	r.offset = 0
+	return i
+}
+
+// Read returns up to limit records following the last one read.
+func (r *Reader) Read(limit int) ([]*Record, error) {
+	r.j.lock.Lock()
+	segments := make([]segment, len(r.j.segments))
+	copy(segments, r.j.segments)
+	r.j.lock.Unlock()
+
+	var records []*Record
+	if len(segments) == 0 {
+		return records, nil
+	}
+	for i := r.position(segments); i < len(segments) && len(records) < limit; i++ {
+		if segments[i].first != r.first {
+			r.first = segments[i].first
+			r.offset = 0
+		}
+		if r.offset == 0 && segments[i].first > r.after+1 {
+			// retention removed records the reader had not reached yet
+			r.skipped += segments[i].first - r.after - 1
+			r.after = segments[i].first - 1
+		}
+		end, err := scanSegment(segments[i].path, r.offset, func(rec *Record, end int64) bool {
+			r.offset = end
+			if rec.Seq <= r.after {
+				return true
+			}
+			r.after = rec.Seq
+			records = append(records, rec)
+			return len(records) < limit
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return records, err
+		}
+		if err == nil {
+			r.offset = end
+		}
+	}
+	return records, nil
+}
+
+// Skipped returns the number of records removed by retention before the
+// reader got to them, since the last call.
+func (r *Reader) Skipped() uint64 {
+	n := r.skipped
+	r.skipped = 0
+	return n
+}
+
+// scanSegment reads the records of a segment from offset. It returns the
+// offset following the last complete line.
+func scanSegment(path string, offset int64, fn func(r *Record, end int64) bool) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// partial trailing line from an interrupted write
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		offset += int64(len(line))
+		r := new(Record)
+		if json.Unmarshal(line, r) != nil {
+			continue
+		}
+		if !fn(r, offset) {
+			return offset, nil
+		}
+	}
+}
+
+func (j *Journal) Cursor(name string) (uint64, bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	seq, ok := j.cursors[name]
+	return seq, ok
+}
+
+func (j *Journal) SetCursor(name string, seq uint64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.cursors[name] < seq {
+		j.cursors[name] = seq
+		j.dirty = true
+	}
+}
+
+func (j *Journal) Sync() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.written {
+		if err := j.file.Sync(); err != nil {
+			return err
+		}
+		j.written = false
+	}
+	if !j.dirty {
+		return nil
+	}
+	data, err := json.Marshal(j.cursors)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(j.dir, cursorsFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	j.dirty = false
+	return nil
+}
+
+func (j *Journal) Close() error {
+	err := j.Sync()
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if cerr := j.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,250 @@
+package journal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func appendN(t *testing.T, j *Journal, n int) {
+	for i := 0; i < n; i++ {
+		if _, err := j.Append("r1", []byte(fmt.Sprintf(`{"index":"%d"}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readAll(t *testing.T, r *Reader, batch int) []uint64 {
+	var seqs []uint64
+	for {
+		records, err := r.Read(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) == 0 {
+			return seqs
+		}
+		for _, rec := range records {
+			seqs = append(seqs, rec.Seq)
+		}
+	}
+}
+
+func checkSeqs(t *testing.T, got []uint64, from, to uint64) {
+	if uint64(len(got)) != to-from+1 {
+		t.Fatalf("read %d records, want %d..%d: %v", len(got), from, to, got)
+	}
+	for i, seq := range got {
+		if seq != from+uint64(i) {
+			t.Fatalf("record %d has seq %d, want %d", i, seq, from+uint64(i))
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	tests := []struct {
+		name         string
+		segmentSize  int64
+		retention    int
+		appends      int
+		batch        int
+		after        uint64
+		wantSegments int
+		wantFirst    uint64
+		wantSkipped  uint64
+	}{
+		{"single segment", 0, 0, 10, 3, 0, 1, 1, 0},
+		{"rotated", 100, 0, 10, 4, 0, 4, 1, 0},
+		{"rotated from cursor", 100, 0, 10, 2, 6, 4, 7, 0},
+		{"retention", 100, 3, 10, 1, 0, 3, 4, 3},
+		{"retention behind cursor", 100, 3, 10, 5, 2, 3, 4, 1},
+		{"retention at cursor", 100, 3, 10, 5, 3, 3, 4, 0},
+		{"segment per record", 40, 0, 10, 3, 4, 10, 5, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			j, err := Open(dir, tt.segmentSize, tt.retention)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer j.Close()
+			appendN(t, j, tt.appends)
+			if got := len(j.segments); got != tt.wantSegments {
+				t.Errorf("got %d segments, want %d", got, tt.wantSegments)
+			}
+			r := j.NewReader(tt.after)
+			checkSeqs(t, readAll(t, r, tt.batch), tt.wantFirst, uint64(tt.appends))
+			if n := r.Skipped(); n != tt.wantSkipped {
+				t.Errorf("got %d skipped records, want %d", n, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestReaderFollowsAppends(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	j, err := Open(dir, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	r := j.NewReader(0)
+	var got []uint64
+	for i := 0; i < 5; i++ {
+		appendN(t, j, 3)
+		got = append(got, readAll(t, r, 2)...)
+	}
+	checkSeqs(t, got, 1, 15)
+}
+
+func TestReaderSkipsRemoved(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	j, err := Open(dir, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	r := j.NewReader(0)
+	appendN(t, j, 3)
+	checkSeqs(t, readAll(t, r, 2), 1, 3)
+	appendN(t, j, 10)
+	first := j.segments[0].first
+	checkSeqs(t, readAll(t, r, 2), first, 13)
+	if n := r.Skipped(); n != first-4 {
+		t.Errorf("got %d skipped records, want %d", n, first-4)
+	}
+	if n := r.Skipped(); n != 0 {
+		t.Errorf("got %d skipped records after reset, want 0", n)
+	}
+}
+
+func TestCursorRestore(t *testing.T) {
+	tests := []struct {
+		name    string
+		cursors map[string]uint64
+		sync    bool
+		want    map[string]uint64
+	}{
+		{"none", nil, true, map[string]uint64{}},
+		{"saved", map[string]uint64{"a": 3, "b": 5}, true, map[string]uint64{"a": 3, "b": 5}},
+		{"saved on close", map[string]uint64{"a": 4}, false, map[string]uint64{"a": 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			j, err := Open(dir, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendN(t, j, 5)
+			for name, seq := range tt.cursors {
+				j.SetCursor(name, seq)
+				// cursors never move backwards
+				j.SetCursor(name, seq-1)
+			}
+			if tt.sync {
+				if err := j.Sync(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := j.Close(); err != nil {
+				t.Fatal(err)
+			}
+			j, err = Open(dir, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer j.Close()
+			if seq := j.Seq(); seq != 5 {
+				t.Errorf("got seq %d, want 5", seq)
+			}
+			if len(j.cursors) != len(tt.want) {
+				t.Errorf("got cursors %v, want %v", j.cursors, tt.want)
+			}
+			for name, want := range tt.want {
+				if seq, ok := j.Cursor(name); !ok || seq != want {
+					t.Errorf("cursor %s is %d, want %d", name, seq, want)
+				}
+			}
+		})
+	}
+}
+
+func TestTruncatedRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		tail    string
+		wantSeq uint64
+	}{
+		{"clean", "", 5},
+		{"partial record", `{"seq":6,"remote":"r1","da`, 5},
+		{"partial line", `{`, 5},
+		{"complete garbage line", "garbage\n", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			j, err := Open(dir, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendN(t, j, 5)
+			path := j.segments[len(j.segments)-1].path
+			j.Close()
+
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString(tt.tail)
+			f.Close()
+
+			j, err = Open(dir, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer j.Close()
+			if seq := j.Seq(); seq != tt.wantSeq {
+				t.Errorf("got seq %d, want %d", seq, tt.wantSeq)
+			}
+			appendN(t, j, 2)
+			checkSeqs(t, readAll(t, j.NewReader(0), 3), 1, tt.wantSeq+2)
+		})
+	}
+}
+
+func TestSyncSkipsUnchanged(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	j, err := Open(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	appendN(t, j, 1)
+	if err := j.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if j.written || j.dirty {
+		t.Fatal("journal still marked as changed after sync")
+	}
+	if _, err := os.Stat(filepath.Join(dir, cursorsFile)); !os.IsNotExist(err) {
+		t.Errorf("cursors written without changes: %v", err)
+	}
+}
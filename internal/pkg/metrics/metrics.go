@@ -0,0 +1,220 @@
+// Package metrics implements a minimal registry of counters and gauges
+// exposed in the Prometheus text format.
+package metrics
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+)
+
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+type metric interface {
+	collect() []Sample
+	desc() (name, help, typ string, labels []string)
+}
+
+var (
+	registry     []metric
+	scrapeHooks  []func()
+	registryLock = new(sync.Mutex)
+)
+
+func register(m metric) error {
+	name, _, _, _ := m.desc()
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	for _, r := range registry {
+		if n, _, _, _ := r.desc(); n == name {
+			return errors.New("metrics: duplicate metric " + name)
+		}
+	}
+	registry = append(registry, m)
+	return nil
+}
+
+// OnScrape registers fn to be called once at the start of every scrape,
+// so several gauge funcs can share one snapshot.
+func OnScrape(fn func()) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	scrapeHooks = append(scrapeHooks, fn)
+}
+
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	lock   *sync.Mutex
+	values map[string]*Sample
+}
+
+func newVec(typ, name, help string, labels []string) *vec {
+	v := &vec{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		lock:   new(sync.Mutex),
+		values: make(map[string]*Sample),
+	}
+	if len(labels) == 0 {
+		// expose label-less metrics from the start
+		v.sample(nil)
+	}
+	if err := register(v); err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func (v *vec) desc() (string, string, string, []string) {
+	return v.name, v.help, v.typ, v.labels
+}
+
+func (v *vec) sample(values []string) *Sample {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\x00")
+	s, ok := v.values[key]
+	if !ok {
+		s = &Sample{Labels: append([]string(nil), values...)}
+		v.values[key] = s
+	}
+	return s
+}
+
+func (v *vec) add(d float64, values []string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.sample(values).Value += d
+}
+
+func (v *vec) collect() []Sample {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	samples := make([]Sample, 0, len(v.values))
+	for _, s := range v.values {
+		samples = append(samples, *s)
+	}
+	return samples
+}
+
+type Counter struct {
+	v *vec
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{newVec(typeCounter, name, help, labels)}
+}
+
+func (c *Counter) Inc(values ...string) {
+	c.v.add(1, values)
+}
+
+func (c *Counter) Value(values ...string) float64 {
+	c.v.lock.Lock()
+	defer c.v.lock.Unlock()
+	return c.v.sample(values).Value
+}
+
+func (c *Counter) Add(d float64, values ...string) {
+	if d < 0 {
+		panic("metrics: counter " + c.v.name + " cannot decrease")
+	}
+	c.v.add(d, values)
+}
+
+// gaugeFunc is collected by calling fn on every scrape.
+type gaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+	fn     func() []Sample
+}
+
+func NewGaugeFunc(name, help string, labels []string, fn func() []Sample) error {
+	return register(&gaugeFunc{name: name, help: help, labels: labels, fn: fn})
+}
+
+func (g *gaugeFunc) desc() (string, string, string, []string) {
+	return g.name, g.help, typeGauge, g.labels
+}
+
+func (g *gaugeFunc) collect() []Sample {
+	return g.fn()
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func write(buf *bytes.Buffer, m metric) {
+	name, help, typ, labels := m.desc()
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help))
+	fmt.Fprintf(buf, "# TYPE %s %s\n", name, typ)
+	lines := make([]string, 0)
+	for _, s := range m.collect() {
+		var b strings.Builder
+		b.WriteString(name)
+		if len(labels) > 0 {
+			b.WriteByte('{')
+			for i, l := range labels {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				v := ""
+				if i < len(s.Labels) {
+					v = s.Labels[i]
+				}
+				fmt.Fprintf(&b, `%s="%s"`, l, escape(v))
+			}
+			b.WriteByte('}')
+		}
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(s.Value, 'g', -1, 64))
+		lines = append(lines, b.String())
+	}
+	sort.Strings(lines)
+	for _, l := range lines {
+		buf.WriteString(l)
+		buf.WriteByte('\n')
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryLock.Lock()
+		metrics := make([]metric, len(registry))
+		copy(metrics, registry)
+		hooks := make([]func(), len(scrapeHooks))
+		copy(hooks, scrapeHooks)
+		registryLock.Unlock()
+
+		for _, fn := range hooks {
+			fn()
+		}
+		buf := new(bytes.Buffer)
+		for _, m := range metrics {
+			write(buf, m)
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,80 @@
+// Package tlsconf builds client TLS configurations from CA bundles,
+// pinned certificate fingerprints and client certificates.
+package tlsconf
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+type Options struct {
+	CAFile      string
+	Fingerprint string
+	ServerName  string
+	CertFile    string
+	KeyFile     string
+	Insecure    bool
+}
+
+func New(o Options) (*tls.Config, error) {
+	c := &tls.Config{ServerName: o.ServerName}
+	if len(o.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tlsconf: reading ca: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tlsconf: no certificates found in %s", o.CAFile)
+		}
+		c.RootCAs = pool
+	}
+	if len(o.CertFile) > 0 || len(o.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tlsconf: loading client certificate: %v", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	if o.Insecure {
+		c.InsecureSkipVerify = true
+		return c, nil
+	}
+	if len(o.Fingerprint) > 0 {
+		pin, err := parseFingerprint(o.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		// a pinned certificate replaces chain verification unless a CA is given
+		c.InsecureSkipVerify = c.RootCAs == nil
+		c.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("tlsconf: no server certificate")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(sum[:], pin) {
+				return fmt.Errorf("tlsconf: certificate fingerprint mismatch: %x", sum)
+			}
+			return nil
+		}
+	}
+	return c, nil
+}
+
+func parseFingerprint(s string) ([]byte, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimPrefix(s, "sha256:")
+	s = strings.Replace(s, ":", "", -1)
+	pin, err := hex.DecodeString(s)
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("tlsconf: invalid sha-256 fingerprint: %s", s)
+	}
+	return pin, nil
+}
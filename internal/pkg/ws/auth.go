@@ -0,0 +1,127 @@
+package ws
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	sec "bs2-evt-filter/pkg/secret"
+)
+
+type authFailure struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func (h *Hub) lockedOut(host string) bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	f, ok := h.failures[host]
+	return ok && time.Now().Before(f.until)
+}
+
+func (h *Hub) authFailed(host string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	now := time.Now()
+	lockout := time.Duration(h.server.AuthLockout) * time.Second
+	for k, f := range h.failures {
+		if now.Sub(f.last) > lockout && now.After(f.until) {
+			delete(h.failures, k)
+		}
+	}
+	f, ok := h.failures[host]
+	if !ok {
+		f = new(authFailure)
+		h.failures[host] = f
+	}
+	f.count++
+	f.last = now
+	if h.server.AuthMaxFailures > 0 && f.count >= h.server.AuthMaxFailures {
+		f.until = now.Add(lockout)
+		f.count = 0
+		h.log("locking out %s for %v after repeated auth failures\n", host, lockout)
+	}
+}
+
+func (h *Hub) authenticate(host string, secret string) (string, bool) {
+	if h.lockedOut(host) {
+		return "", false
+	}
+	if len(secret) == 0 {
+		h.authFailed(host)
+		return "", false
+	}
+	// compare outside the lock, bcrypt is slow
+	h.lock.RLock()
+	var plain, hashed []string
+	names := make(map[string]string, len(h.auth))
+	for s, n := range h.auth {
+		if sec.IsHashed(s) {
+			hashed = append(hashed, s)
+		} else {
+			plain = append(plain, s)
+		}
+		names[s] = n
+	}
+	h.lock.RUnlock()
+	name := ""
+	ok := false
+	for _, s := range plain {
+		if sec.Compare(s, secret) {
+			name = names[s]
+			ok = true
+		}
+	}
+	for _, s := range hashed {
+		if ok {
+			break
+		}
+		if sec.Compare(s, secret) {
+			name = names[s]
+			ok = true
+		}
+	}
+	if !ok {
+		h.authFailed(host)
+		return "", false
+	}
+	h.lock.Lock()
+	delete(h.failures, host)
+	h.lock.Unlock()
+	return name, true
+}
+
+func certIdentities(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	cert := r.TLS.PeerCertificates[0]
+	ids := []string{cert.Subject.CommonName}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	return ids
+}
+
+func (h *Hub) authenticateCert(r *http.Request) (string, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for _, id := range certIdentities(r) {
+		if name, ok := h.certs[id]; ok && len(id) > 0 {
+			return name, true
+		}
+	}
+	return "", false
+}
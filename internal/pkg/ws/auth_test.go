@@ -0,0 +1,130 @@
+package ws
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"bs2-evt-filter/internal/pkg/config"
+	"github.com/gorilla/websocket"
+)
+
+const testSecret = "s3cret"
+
+func testServer(t *testing.T, server config.ServerConf) *httptest.Server {
+	h := NewHub(0)
+	h.UpdateServer(server)
+	h.UpdateClients(config.ClientsConf{Auth: map[string]string{testSecret: "test"}})
+	go h.Run()
+	return httptest.NewServer(http.HandlerFunc(h.Client))
+}
+
+func dial(t *testing.T, srv *httptest.Server) (*websocket.Conn, int) {
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err == websocket.ErrBadHandshake {
+		return nil, resp.StatusCode
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, resp.StatusCode
+}
+
+func auth(t *testing.T, conn *websocket.Conn, secret string) string {
+	data, err := json.Marshal(&request{Type: "auth", Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err = conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r reply
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+	return r.Type
+}
+
+func TestAuthLockout(t *testing.T) {
+	srv := testServer(t, config.ServerConf{AuthMaxFailures: 3, AuthLockout: 60})
+	defer srv.Close()
+
+	conn, _ := dial(t, srv)
+	defer conn.Close()
+	steps := []struct {
+		secret string
+		want   string
+	}{
+		{"wrong", replyAuthFailed},
+		{"", replyAuthFailed},
+		// a successful auth clears the failure count
+		{testSecret, replyAuthOK},
+		{"wrong", replyAuthFailed},
+		{"wrong", replyAuthFailed},
+	}
+	for i, s := range steps {
+		if got := auth(t, conn, s.secret); got != s.want {
+			t.Fatalf("step %d: got %s, want %s", i, got, s.want)
+		}
+	}
+
+	other, status := dial(t, srv)
+	if other == nil {
+		t.Fatalf("locked out before reaching the limit, got status %d", status)
+	}
+	defer other.Close()
+	if got := auth(t, other, "wrong"); got != replyAuthFailed {
+		t.Fatalf("got %s, want %s", got, replyAuthFailed)
+	}
+	// locked out hosts are refused even with the right secret
+	if got := auth(t, other, testSecret); got != replyAuthFailed {
+		t.Fatalf("got %s after lockout, want %s", got, replyAuthFailed)
+	}
+	if conn, status := dial(t, srv); conn != nil || status != http.StatusTooManyRequests {
+		if conn != nil {
+			conn.Close()
+		}
+		t.Fatalf("got status %d after lockout, want %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		closed bool
+	}{
+		{"no auth", "", true},
+		{"authenticated", testSecret, false},
+	}
+	srv := testServer(t, config.ServerConf{AuthTimeout: 1})
+	defer srv.Close()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _ := dial(t, srv)
+			defer conn.Close()
+			if len(tt.secret) > 0 {
+				if got := auth(t, conn, tt.secret); got != replyAuthOK {
+					t.Fatalf("got %s, want %s", got, replyAuthOK)
+				}
+			}
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, _, err := conn.ReadMessage()
+			timedOut := false
+			if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+				timedOut = true
+			}
+			if closed := err != nil && !timedOut; closed != tt.closed {
+				t.Errorf("got closed %v (%v), want %v", closed, err, tt.closed)
+			}
+		})
+	}
+}
@@ -2,10 +2,16 @@ package ws
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"bs2-evt-filter/pkg/expr"
 	"github.com/gorilla/websocket"
 )
 
@@ -21,10 +27,24 @@ var (
 )
 
 type Client struct {
-	hub  *Hub
-	conn *websocket.Conn
-	auth bool
-	send chan []byte
+	hub      *Hub
+	conn     *websocket.Conn
+	auth     bool
+	name     string
+	filter   *expr.Expr
+	lock     *sync.Mutex
+	send     chan *Message
+	jsonMode bool
+
+	closed chan struct{}
+
+	cursor     uint64
+	catchingUp bool
+
+	// live is owned by the hub, resuming holds remotes out of the live
+	// broadcast until their replay is queued.
+	live     map[string]liveRange
+	resuming map[string]bool
 }
 
 func (c *Client) log(f string, v ...interface{}) {
@@ -32,23 +52,217 @@ func (c *Client) log(f string, v ...interface{}) {
 	log.Printf(msg+f, v...)
 }
 
+func (c *Client) doAuth(secret string) (string, error) {
+	name, ok := c.hub.authenticate(remoteHost(c.conn.RemoteAddr().String()), secret)
+	if !ok {
+		c.log("auth unsucessful\n")
+		return "", errors.New("invalid secret")
+	}
+	c.log("auth as '%s' successful\n", name)
+	c.lock.Lock()
+	c.auth = true
+	c.name = name
+	c.lock.Unlock()
+	return name, nil
+}
+
+func (c *Client) doSubscribe(args string) (*expr.Expr, error) {
+	filter, err := expr.Compile(args)
+	if err != nil {
+		c.log("subscribe failed: %v\n", err)
+		return nil, err
+	}
+	c.log("subscribed: %s\n", filter)
+	c.lock.Lock()
+	c.filter = filter
+	c.lock.Unlock()
+	return filter, nil
+}
+
+func (c *Client) doUnsubscribe() {
+	c.log("unsubscribed\n")
+	c.lock.Lock()
+	c.filter = nil
+	c.lock.Unlock()
+}
+
+func (c *Client) parseIndex(idx string) (uint64, error) {
+	index, err := strconv.ParseUint(idx, 10, 64)
+	if err != nil {
+		c.log("resume failed: invalid index: %s\n", idx)
+		return 0, fmt.Errorf("invalid index: %s", idx)
+	}
+	return index, nil
+}
+
+func (c *Client) doResume(remote string, index uint64) {
+	c.lock.Lock()
+	c.resuming[remote] = true
+	c.lock.Unlock()
+	c.hub.resume <- &resumeRequest{client: c, remote: remote, index: index}
+}
+
+func (c *Client) holding(remote string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.resuming[remote]
+}
+
+func (c *Client) release(remote string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.resuming, remote)
+}
+
+func (c *Client) markLive(remote string, n uint64) {
+	r := c.live[remote]
+	if r.first == 0 {
+		r.first = n
+	}
+	r.last = n
+	c.live[remote] = r
+}
+
+func (c *Client) status() *clientStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	st := &clientStatus{Authenticated: c.auth, Client: c.name}
+	if c.filter != nil {
+		st.Filter = c.filter.String()
+	}
+	return st
+}
+
 func (c *Client) command(cmd string, args string) {
 	c.log("command: %s, arglen: %d\n", cmd, len(args))
 	switch cmd {
 	case "auth":
-		if len(args) > 0 {
-			// ac := getClientsAuthConf()
-			name, ok := c.hub.auth[args]
-			if ok {
-				c.log("auth as '%s' successful\n", name)
-				c.auth = true
-			} else {
-				c.log("auth unsucessful\n")
-			}
+		if len(args) == 0 {
+			return
+		}
+		if _, err := c.doAuth(args); err == nil {
+			c.hub.catchup <- c
+		}
+	case "subscribe":
+		c.doSubscribe(args)
+	case "resume":
+		parts := strings.Fields(args)
+		if len(parts) != 2 {
+			c.log("resume failed: expected <remote> <index>\n")
+			return
+		}
+		if index, err := c.parseIndex(parts[1]); err == nil {
+			c.doResume(parts[0], index)
+		}
+	case "unsubscribe":
+		c.doUnsubscribe()
+	}
+}
+
+func (c *Client) request(message []byte) {
+	var req request
+	if err := json.Unmarshal(message, &req); err != nil {
+		c.reply(errorReply("", replyError, fmt.Errorf("invalid request: %v", err)))
+		return
+	}
+	c.log("request: %s, id: %s\n", req.Type, req.ID)
+	if req.Version != 0 && req.Version != protocolVersion {
+		c.reply(errorReply(req.ID, replyError, fmt.Errorf("unsupported protocol version: %d", req.Version)))
+		return
+	}
+	switch req.Type {
+	case "auth":
+		if len(req.Secret) == 0 {
+			c.reply(errorReply(req.ID, replyAuthFailed, errors.New("empty secret")))
+			return
+		}
+		name, err := c.doAuth(req.Secret)
+		if err != nil {
+			c.reply(errorReply(req.ID, replyAuthFailed, err))
+			return
 		}
+		r := newReply(req.ID, replyAuthOK)
+		r.Client = name
+		c.reply(r)
+		c.hub.catchup <- c
+	case "subscribe":
+		filter, err := c.doSubscribe(req.Filter)
+		if err != nil {
+			c.reply(errorReply(req.ID, replyError, err))
+			return
+		}
+		r := newReply(req.ID, replySubscribed)
+		r.Filter = filter.String()
+		c.reply(r)
+	case "unsubscribe":
+		c.doUnsubscribe()
+		c.reply(newReply(req.ID, replyUnsubscribed))
+	case "resume":
+		index, err := c.parseIndex(req.Index)
+		if err != nil {
+			c.reply(errorReply(req.ID, replyError, err))
+			return
+		}
+		r := newReply(req.ID, replyResumed)
+		r.Remote = req.Remote
+		c.reply(r)
+		c.doResume(req.Remote, index)
+	case "status":
+		r := newReply(req.ID, replyStatus)
+		r.Status = c.status()
+		c.reply(r)
+	default:
+		c.reply(errorReply(req.ID, replyError, fmt.Errorf("unknown request type: %s", req.Type)))
 	}
 }
 
+func (c *Client) reply(r *reply) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		c.log("reply error: %v\n", err)
+		return
+	}
+	c.hub.replies <- &replyRequest{client: c, data: data}
+}
+
+func (c *Client) isJSON() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.jsonMode
+}
+
+func (c *Client) format(m *Message) []byte {
+	if m.reply || !c.isJSON() {
+		return m.Data
+	}
+	data, err := json.Marshal(eventReply(m))
+	if err != nil {
+		return m.Data
+	}
+	return data
+}
+
+func (c *Client) authenticated() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.auth
+}
+
+func (c *Client) clientName() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.name
+}
+
+func (c *Client) accepts(m *Message) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.auth || !c.hub.allowed(c.name, m) {
+		return false
+	}
+	return c.filter == nil || m.Event == nil || c.filter.Match(m)
+}
+
 func (c *Client) read() {
 	defer func() {
 		c.hub.unregister <- c
@@ -66,6 +280,13 @@ func (c *Client) read() {
 			break
 		}
 		message = bytes.TrimSpace(message)
+		if len(message) > 0 && message[0] == '{' {
+			c.lock.Lock()
+			c.jsonMode = true
+			c.lock.Unlock()
+			c.request(message)
+			continue
+		}
 		cmd := bytes.SplitN(message, space, 2)
 		if cmd != nil && len(cmd[0]) > 0 {
 			args := ""
@@ -81,6 +302,7 @@ func (c *Client) write() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
+		close(c.closed)
 		c.conn.Close()
 	}()
 	for {
@@ -96,17 +318,29 @@ func (c *Client) write() {
 			if err != nil {
 				return
 			}
-			w.Write(message)
+			w.Write(c.format(message))
+			seq := message.Seq
 
+			// plain messages are batched, JSON messages are sent one per frame
 			n := len(c.send)
+			if c.isJSON() {
+				n = 0
+			}
 			for i := 0; i < n; i++ {
+				message = <-c.send
 				w.Write(newline)
-				w.Write(<-c.send)
+				w.Write(c.format(message))
+				if message.Seq > seq {
+					seq = message.Seq
+				}
 			}
 
 			if err := w.Close(); err != nil {
 				return
 			}
+			if seq > 0 {
+				c.hub.ack(c, seq)
+			}
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -1,9 +1,16 @@
 package ws
 
 import (
+	"encoding/json"
 	"log"
 	"net/http"
+	"sync"
+	"time"
 
+	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/internal/pkg/journal"
+	"bs2-evt-filter/internal/pkg/metrics"
+	"bs2-evt-filter/pkg/biostar2"
 	"github.com/gorilla/websocket"
 )
 
@@ -16,27 +23,121 @@ var upgrader = websocket.Upgrader{
 type Hub struct {
 	clients    map[*Client]bool
 	auth       map[string]string
-	broadcast  chan []byte
+	certs      map[string]string
+	acl        map[string]config.ACLConf
+	server     config.ServerConf
+	failures   map[string]*authFailure
+	lock       *sync.RWMutex
+	broadcast  chan *Message
 	register   chan *Client
 	unregister chan *Client
+	resume     chan *resumeRequest
+	replies    chan *replyRequest
+	remotes    chan map[string]bool
+	replay     map[string]*replayBuffer
+	replaySize int
+	catchup    chan *Client
+	backlog    chan *backlogBatch
+	stats      chan chan Stats
+	journal    *journal.Journal
 }
 
-func NewHub() *Hub {
+// backlogBatch carries journal records read for a catching up client to
+// the hub. seq is the journal sequence before the read, skipped the number
+// of records removed by retention before they were read, more tells the
+// reader whether to go on.
+type backlogBatch struct {
+	client  *Client
+	records []*journal.Record
+	seq     uint64
+	skipped uint64
+	more    chan bool
+}
+
+type Stats struct {
+	Connected     int `json:"connected"`
+	Authenticated int `json:"authenticated"`
+
+	queues []metrics.Sample
+}
+
+func NewHub(replaySize int) *Hub {
 	return &Hub{
 		clients:    make(map[*Client]bool),
 		auth:       make(map[string]string),
-		broadcast:  make(chan []byte),
+		certs:      make(map[string]string),
+		acl:        make(map[string]config.ACLConf),
+		failures:   make(map[string]*authFailure),
+		lock:       new(sync.RWMutex),
+		broadcast:  make(chan *Message),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		resume:     make(chan *resumeRequest),
+		replies:    make(chan *replyRequest),
+		remotes:    make(chan map[string]bool),
+		replay:     make(map[string]*replayBuffer),
+		replaySize: replaySize,
+		catchup:    make(chan *Client),
+		backlog:    make(chan *backlogBatch),
+		stats:      make(chan chan Stats),
 	}
 }
 
-func (h *Hub) Broadcast(msg []byte) {
-	h.broadcast <- msg
+func (h *Hub) SetJournal(j *journal.Journal) {
+	h.journal = j
+}
+
+func (h *Hub) Broadcast(remote string, e *biostar2.Event, data []byte) {
+	h.broadcast <- &Message{Remote: remote, Event: e, Data: data}
+}
+
+func (h *Hub) Notify(remote string, data []byte) {
+	h.broadcast <- &Message{Remote: remote, Data: data}
+}
+
+func (h *Hub) Stats() Stats {
+	c := make(chan Stats, 1)
+	h.stats <- c
+	return <-c
 }
 
-func (h *Hub) UpdateAuth(auth map[string]string) {
-	h.auth = auth
+func (h *Hub) UpdateClients(clients config.ClientsConf) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.auth = clients.Auth
+	h.certs = clients.Certs
+	h.acl = clients.ACL
+}
+
+func (h *Hub) UpdateServer(server config.ServerConf) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.server = server
+}
+
+// UpdateRemotes drops the replay buffers of remotes no longer configured.
+func (h *Hub) UpdateRemotes(remotes map[string]config.RemoteConf) {
+	names := make(map[string]bool)
+	for name := range remotes {
+		names[name] = true
+	}
+	h.remotes <- names
+}
+
+func (h *Hub) allowed(name string, m *Message) bool {
+	h.lock.RLock()
+	acl, ok := h.acl[name]
+	h.lock.RUnlock()
+	if !ok {
+		return true
+	}
+	if len(acl.Remotes) > 0 && !acl.Remotes[m.Remote] {
+		return false
+	}
+	if m.Event != nil && len(acl.EventTypeCodes) > 0 && !acl.EventTypeCodes[m.Event.EventType.Code] {
+		return false
+	}
+	return true
 }
 
 func (h *Hub) log(f string, v ...interface{}) {
@@ -48,11 +149,21 @@ func (h *Hub) newClient(conn *websocket.Conn) *Client {
 		hub:  h,
 		conn: conn,
 		auth: false,
-		send: make(chan []byte, 512),
+		lock: new(sync.Mutex),
+		send: make(chan *Message, 512+h.replaySize),
+		live: make(map[string]liveRange),
+
+		resuming: make(map[string]bool),
+		closed:   make(chan struct{}),
 	}
 }
 
 func (h *Hub) Client(w http.ResponseWriter, r *http.Request) {
+	if h.lockedOut(remoteHost(r.RemoteAddr)) {
+		h.log("rejecting locked out client: %v", r.RemoteAddr)
+		http.Error(w, "too many failed auth attempts", http.StatusTooManyRequests)
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		h.log("websocket connection error: %v", err)
@@ -63,32 +174,249 @@ func (h *Hub) Client(w http.ResponseWriter, r *http.Request) {
 	client.hub.register <- client
 	go client.write()
 	go client.read()
+
+	if name, ok := h.authenticateCert(r); ok {
+		client.log("auth as '%s' by certificate\n", name)
+		client.lock.Lock()
+		client.auth = true
+		client.name = name
+		client.lock.Unlock()
+		h.catchup <- client
+		return
+	}
+
+	h.lock.RLock()
+	timeout := time.Duration(h.server.AuthTimeout) * time.Second
+	h.lock.RUnlock()
+	if timeout > 0 {
+		time.AfterFunc(timeout, func() {
+			if !client.authenticated() {
+				client.log("auth timeout, disconnecting\n")
+				client.conn.Close()
+			}
+		})
+	}
 }
 
 func (h *Hub) Run() {
+	syncTicker := time.NewTicker(time.Second)
+	defer syncTicker.Stop()
 	for {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
+			clientConnects.Inc()
 			h.log("websocket client connected: %v\n", client.conn.RemoteAddr())
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
 				h.log("websocket client disconnected: %v\n", client.conn.RemoteAddr())
 				delete(h.clients, client)
 				close(client.send)
+				clientDisconnects.Inc()
 			}
 		case message := <-h.broadcast:
+			var n uint64
+			if message.Event != nil {
+				n = h.record(message)
+			}
 			for client := range h.clients {
-				if !client.auth {
+				if client.catchingUp || client.holding(message.Remote) || !client.accepts(message) {
 					continue
 				}
-				select {
-				case client.send <- message:
-				default:
-					close(client.send)
-					delete(h.clients, client)
+				if h.queue(client, message) && n > 0 {
+					client.markLive(message.Remote, n)
+				}
+			}
+		case req := <-h.replies:
+			if _, ok := h.clients[req.client]; ok {
+				h.queue(req.client, &Message{Data: req.data, reply: true})
+			}
+		case req := <-h.resume:
+			if _, ok := h.clients[req.client]; !ok {
+				continue
+			}
+			if buf, ok := h.replay[req.remote]; ok {
+				msgs := buf.since(req.index, req.client.live[req.remote])
+				h.log("websocket client %v resuming %s from %d (%d events)\n", req.client.conn.RemoteAddr(), req.remote, req.index, len(msgs))
+				for _, message := range msgs {
+					if !h.send(req.client, message) {
+						break
+					}
+				}
+			}
+			req.client.release(req.remote)
+		case names := <-h.remotes:
+			for remote := range h.replay {
+				if names[remote] {
+					continue
+				}
+				h.log("dropping replay buffer of removed remote %s\n", remote)
+				delete(h.replay, remote)
+				for client := range h.clients {
+					delete(client.live, remote)
+				}
+			}
+		case client := <-h.catchup:
+			if _, ok := h.clients[client]; !ok || h.journal == nil {
+				continue
+			}
+			name := client.clientName()
+			seq, ok := h.journal.Cursor(name)
+			if !ok {
+				h.journal.SetCursor(name, h.journal.Seq())
+				continue
+			}
+			client.cursor = seq
+			client.catchingUp = true
+			go h.readBacklog(client, h.journal.NewReader(seq))
+		case b := <-h.backlog:
+			b.more <- h.sendBacklog(b)
+		case c := <-h.stats:
+			stats := Stats{Connected: len(h.clients)}
+			queues := make(map[string]int)
+			for client := range h.clients {
+				if client.authenticated() {
+					stats.Authenticated++
+				}
+				queues[client.clientName()] += len(client.send)
+			}
+			stats.queues = queueSamples(queues)
+			c <- stats
+		case <-syncTicker.C:
+			if h.journal != nil {
+				if err := h.journal.Sync(); err != nil {
+					h.log("journal sync error: %v\n", err)
+				}
+			}
+		}
+	}
+}
+
+func (h *Hub) record(message *Message) uint64 {
+	if h.journal != nil {
+		seq, err := h.journal.Append(message.Remote, message.Data)
+		if err != nil {
+			h.log("journal append error: %v\n", err)
+		}
+		message.Seq = seq
+	}
+	buf, ok := h.replay[message.Remote]
+	if !ok {
+		buf = newReplayBuffer(h.replaySize)
+		h.replay[message.Remote] = buf
+	}
+	return buf.add(message)
+}
+
+// readBacklog reads the journal for a catching up client whenever its
+// send queue has room, so disk reads stay out of the hub loop.
+func (h *Hub) readBacklog(client *Client, reader *journal.Reader) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if free := cap(client.send) - len(client.send); free > 0 {
+			seq := h.journal.Seq()
+			records, err := reader.Read(free)
+			if err != nil {
+				h.log("journal read error: %v\n", err)
+			} else {
+				b := &backlogBatch{
+					client:  client,
+					records: records,
+					seq:     seq,
+					skipped: reader.Skipped(),
+					more:    make(chan bool, 1),
+				}
+				h.backlog <- b
+				if !<-b.more {
+					return
+				}
+				if len(records) == free {
+					continue
 				}
 			}
 		}
+		select {
+		case <-ticker.C:
+		case <-client.closed:
+			return
+		}
+	}
+}
+
+// sendBacklog queues a batch of journal records. Once the reader runs out
+// of records and nothing was appended since, the client goes live.
+func (h *Hub) sendBacklog(b *backlogBatch) bool {
+	client := b.client
+	if _, ok := h.clients[client]; !ok {
+		return false
+	}
+	if b.skipped > 0 && !h.journalGap(client, b.skipped) {
+		return false
+	}
+	for _, r := range b.records {
+		client.cursor = r.Seq
+		e, ok := biostar2.ParseEvent(r.Data)
+		if !ok {
+			continue
+		}
+		message := &Message{Remote: r.Remote, Event: e, Data: r.Data, Seq: r.Seq}
+		if !h.send(client, message) {
+			return false
+		}
+	}
+	if len(b.records) > 0 || h.journal.Seq() > b.seq {
+		return true
+	}
+	client.catchingUp = false
+	h.log("websocket client %v caught up at %d\n", client.conn.RemoteAddr(), client.cursor)
+	return false
+}
+
+// journalGap tells a catching up client that journal retention removed
+// records it had not received yet.
+func (h *Hub) journalGap(client *Client, skipped uint64) bool {
+	g := journalGap{From: client.cursor + 1, To: client.cursor + skipped, Missing: skipped}
+	name := client.clientName()
+	h.log("websocket client %v (%s): journal records %d to %d were removed before delivery, %d missing\n",
+		client.conn.RemoteAddr(), name, g.From, g.To, skipped)
+	journalSkipped.Add(float64(skipped), name)
+	client.cursor = g.To
+	data, err := json.Marshal(&journalGapNotice{g})
+	if err != nil {
+		return true
+	}
+	return h.queue(client, &Message{Data: data})
+}
+
+func (h *Hub) ack(client *Client, seq uint64) {
+	if h.journal == nil {
+		return
+	}
+	if name := client.clientName(); len(name) > 0 {
+		h.journal.SetCursor(name, seq)
+	}
+}
+
+func (h *Hub) send(client *Client, message *Message) bool {
+	if !client.accepts(message) {
+		return true
+	}
+	return h.queue(client, message)
+}
+
+// queue adds a message to the client's send queue, disconnecting the
+// client if the queue is full.
+func (h *Hub) queue(client *Client, message *Message) bool {
+	select {
+	case client.send <- message:
+		return true
+	default:
+		h.log("websocket client %v send queue full, disconnecting\n", client.conn.RemoteAddr())
+		close(client.send)
+		delete(h.clients, client)
+		clientEvictions.Inc()
+		clientDisconnects.Inc()
+		return false
 	}
 }
@@ -0,0 +1,24 @@
+package ws
+
+import (
+	"bs2-evt-filter/pkg/biostar2"
+)
+
+type Message struct {
+	Remote string
+	Event  *biostar2.Event
+	Data   []byte
+	Seq    uint64
+
+	reply bool
+}
+
+func (m *Message) Field(name string) []string {
+	if name == "remote" {
+		return []string{m.Remote}
+	}
+	if m.Event == nil {
+		return nil
+	}
+	return m.Event.Field(name)
+}
@@ -0,0 +1,66 @@
+package ws
+
+import (
+	"sort"
+	"sync"
+
+	"bs2-evt-filter/internal/pkg/metrics"
+)
+
+var (
+	clientConnects    = metrics.NewCounter("bs2_hub_client_connects_total", "Websocket client connections.")
+	clientDisconnects = metrics.NewCounter("bs2_hub_client_disconnects_total", "Websocket client disconnections, including evictions.")
+	clientEvictions   = metrics.NewCounter("bs2_hub_client_evictions_total", "Websocket clients disconnected because their send queue was full.")
+	journalSkipped    = metrics.NewCounter("bs2_hub_journal_skipped_total", "Journal records removed by retention before a client received them.", "client")
+)
+
+// RegisterMetrics exposes the hub's client gauges. The hub stats are read
+// once per scrape and shared by the gauges.
+func (h *Hub) RegisterMetrics() error {
+	lock := new(sync.Mutex)
+	var stats Stats
+	snapshot := func() Stats {
+		lock.Lock()
+		defer lock.Unlock()
+		return stats
+	}
+	err := metrics.NewGaugeFunc("bs2_hub_clients", "Connected websocket clients.", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(snapshot().Connected)}}
+	})
+	if err != nil {
+		return err
+	}
+	err = metrics.NewGaugeFunc("bs2_hub_authenticated_clients", "Authenticated websocket clients.", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(snapshot().Authenticated)}}
+	})
+	if err != nil {
+		return err
+	}
+	err = metrics.NewGaugeFunc("bs2_hub_client_send_queue", "Messages waiting in the send queues of a client's websocket connections.", []string{"client"}, func() []metrics.Sample {
+		return snapshot().queues
+	})
+	if err != nil {
+		return err
+	}
+	metrics.OnScrape(func() {
+		s := h.Stats()
+		lock.Lock()
+		stats = s
+		lock.Unlock()
+	})
+	return nil
+}
+
+// queueSamples sums the send queues by client name.
+func queueSamples(queues map[string]int) []metrics.Sample {
+	names := make([]string, 0, len(queues))
+	for name := range queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	samples := make([]metrics.Sample, 0, len(names))
+	for _, name := range names {
+		samples = append(samples, metrics.Sample{Labels: []string{name}, Value: float64(queues[name])})
+	}
+	return samples
+}
@@ -0,0 +1,87 @@
+package ws
+
+import (
+	"encoding/json"
+)
+
+const protocolVersion = 1
+
+const (
+	replyAuthOK       = "auth_ok"
+	replyAuthFailed   = "auth_failed"
+	replyError        = "error"
+	replySubscribed   = "subscribed"
+	replyUnsubscribed = "unsubscribed"
+	replyResumed      = "resumed"
+	replyEvent        = "event"
+	replyNotice       = "notice"
+	replyStatus       = "status"
+)
+
+type request struct {
+	Version int    `json:"v"`
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Secret  string `json:"secret,omitempty"`
+	Filter  string `json:"filter,omitempty"`
+	Remote  string `json:"remote,omitempty"`
+	Index   string `json:"index,omitempty"`
+}
+
+type reply struct {
+	Version  int             `json:"v"`
+	ID       string          `json:"id,omitempty"`
+	Type     string          `json:"type"`
+	Error    string          `json:"error,omitempty"`
+	Client   string          `json:"client,omitempty"`
+	Filter   string          `json:"filter,omitempty"`
+	Remote   string          `json:"remote,omitempty"`
+	Seq      uint64          `json:"seq,omitempty"`
+	Backfill bool            `json:"backfill,omitempty"`
+	Event    json.RawMessage `json:"event,omitempty"`
+	Notice   json.RawMessage `json:"notice,omitempty"`
+	Status   *clientStatus   `json:"status,omitempty"`
+}
+
+type clientStatus struct {
+	Authenticated bool   `json:"authenticated"`
+	Client        string `json:"client,omitempty"`
+	Filter        string `json:"filter,omitempty"`
+}
+
+// journalGapNotice is sent to a client catching up from the journal when
+// retention removed records it had not received.
+type journalGapNotice struct {
+	JournalGap journalGap `json:"JournalGap"`
+}
+
+type journalGap struct {
+	From    uint64 `json:"from"`
+	To      uint64 `json:"to"`
+	Missing uint64 `json:"missing"`
+}
+
+func newReply(id string, typ string) *reply {
+	return &reply{Version: protocolVersion, ID: id, Type: typ}
+}
+
+func errorReply(id string, typ string, err error) *reply {
+	r := newReply(id, typ)
+	r.Error = err.Error()
+	return r
+}
+
+func eventReply(m *Message) *reply {
+	if m.Event == nil {
+		r := newReply("", replyNotice)
+		r.Remote = m.Remote
+		r.Notice = m.Data
+		return r
+	}
+	r := newReply("", replyEvent)
+	r.Remote = m.Remote
+	r.Seq = m.Seq
+	r.Backfill = m.Event.Backfill
+	r.Event = m.Event.Raw
+	return r
+}
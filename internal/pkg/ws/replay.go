@@ -0,0 +1,77 @@
+package ws
+
+import (
+	"strconv"
+)
+
+// replyRequest queues a reply behind the messages already sent to the
+// client.
+type replyRequest struct {
+	client *Client
+	data   []byte
+}
+
+type resumeRequest struct {
+	client *Client
+	remote string
+	index  uint64
+}
+
+type replayEntry struct {
+	msg *Message
+	n   uint64
+}
+
+// replayBuffer keeps the last events of a remote. Every event is numbered
+// so a resuming client can skip those it already got live.
+type replayBuffer struct {
+	entries []replayEntry
+	next    int
+	full    bool
+	n       uint64
+}
+
+// liveRange is the span of replay numbers a client got through the live
+// broadcast.
+type liveRange struct {
+	first uint64
+	last  uint64
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{entries: make([]replayEntry, size)}
+}
+
+func (b *replayBuffer) add(m *Message) uint64 {
+	if len(b.entries) == 0 {
+		return 0
+	}
+	b.n++
+	b.entries[b.next] = replayEntry{msg: m, n: b.n}
+	b.next = (b.next + 1) % len(b.entries)
+	if b.next == 0 {
+		b.full = true
+	}
+	return b.n
+}
+
+// since returns the events after index, leaving out those within live.
+func (b *replayBuffer) since(index uint64, live liveRange) []*Message {
+	var ordered []replayEntry
+	if b.full {
+		ordered = append(ordered, b.entries[b.next:]...)
+	}
+	ordered = append(ordered, b.entries[:b.next]...)
+	msgs := make([]*Message, 0, len(ordered))
+	for _, e := range ordered {
+		if live.first > 0 && e.n >= live.first && e.n <= live.last {
+			continue
+		}
+		i, err := strconv.ParseUint(e.msg.Event.Index, 10, 64)
+		if err != nil || i <= index {
+			continue
+		}
+		msgs = append(msgs, e.msg)
+	}
+	return msgs
+}
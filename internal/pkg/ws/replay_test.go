@@ -0,0 +1,56 @@
+package ws
+
+import (
+	"reflect"
+	"testing"
+
+	"bs2-evt-filter/pkg/biostar2"
+)
+
+func TestReplaySince(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		adds  []string
+		index uint64
+		live  liveRange
+		want  []string
+	}{
+		{"empty", 3, nil, 0, liveRange{}, []string{}},
+		{"size 0", 0, []string{"1", "2", "3"}, 0, liveRange{}, []string{}},
+		{"partial", 5, []string{"1", "2", "3"}, 1, liveRange{}, []string{"2", "3"}},
+		{"full", 3, []string{"1", "2", "3"}, 0, liveRange{}, []string{"1", "2", "3"}},
+		{"wrapped", 3, []string{"1", "2", "3", "4", "5"}, 0, liveRange{}, []string{"3", "4", "5"}},
+		{"wrapped from index", 3, []string{"1", "2", "3", "4", "5"}, 3, liveRange{}, []string{"4", "5"}},
+		{"wrapped twice", 2, []string{"1", "2", "3", "4", "5"}, 0, liveRange{}, []string{"4", "5"}},
+		{"after last", 3, []string{"1", "2", "3"}, 3, liveRange{}, []string{}},
+		{"invalid index", 3, []string{"1", "x", "3"}, 0, liveRange{}, []string{"1", "3"}},
+		{"live", 5, []string{"1", "2", "3", "4", "5"}, 0, liveRange{2, 4}, []string{"1", "5"}},
+		{"live wrapped", 3, []string{"1", "2", "3", "4", "5"}, 0, liveRange{4, 5}, []string{"3"}},
+		{"live and index", 5, []string{"1", "2", "3", "4", "5"}, 2, liveRange{4, 4}, []string{"3", "5"}},
+		// replay numbers, not event indexes, tell what was sent live
+		{"live after reset", 5, []string{"7", "8", "1", "2", "3"}, 0, liveRange{1, 2}, []string{"1", "2", "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newReplayBuffer(tt.size)
+			for i, index := range tt.adds {
+				want := uint64(i + 1)
+				if tt.size == 0 {
+					want = 0
+				}
+				m := &Message{Remote: "r1", Event: &biostar2.Event{Index: index}}
+				if n := b.add(m); n != want {
+					t.Fatalf("add %s returned %d, want %d", index, n, want)
+				}
+			}
+			got := []string{}
+			for _, m := range b.since(tt.index, tt.live) {
+				got = append(got, m.Event.Index)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"strings"
 
 	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/pkg/secret"
 	"bs2-evt-filter/pkg/sstr"
 	"bs2-evt-filter/pkg/svc"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 func usage() {
@@ -19,6 +24,7 @@ func usage() {
 		"\tservice      service commands\n"+
 		"\tprotect      protect string\n"+
 		"\tunprotect    unprotect string\n"+
+		"\thash-secret  hash client secret\n"+
 		"\n", path.Base(appPath()))
 	os.Exit(2)
 }
@@ -43,6 +49,32 @@ func errOut(err error) {
 	}
 }
 
+// readSecret prompts for a secret without echo, or reads the first line
+// of standard input when it is not a terminal.
+func readSecret() (string, error) {
+	var s string
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Secret: ")
+		b, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		s = string(b)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		s = strings.TrimRight(line, "\r\n")
+	}
+	if len(s) == 0 {
+		return "", errors.New("empty secret")
+	}
+	return s, nil
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		usage()
@@ -75,6 +107,16 @@ func main() {
 		s, err := sstr.UnprotectString(os.Args[2])
 		errOut(err)
 		fmt.Fprintln(os.Stdout, s)
+	case "hash-secret":
+		if len(os.Args) != 2 {
+			fmt.Fprintf(os.Stderr, "\nUsage:\n\t%s\n\nThe secret is read from standard input.\n\n", cmd)
+			os.Exit(2)
+		}
+		s, err := readSecret()
+		errOut(err)
+		h, err := secret.Hash(s)
+		errOut(err)
+		fmt.Fprintln(os.Stdout, h)
 	default:
 		usage()
 	}
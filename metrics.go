@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bs2-evt-filter/internal/pkg/metrics"
+)
+
+var (
+	eventsReceived      = metrics.NewCounter("bs2_events_received_total", "Events received from BioStar2.", "remote", "event_type")
+	eventsFiltered      = metrics.NewCounter("bs2_events_filtered_total", "Events that passed the filter and were broadcast.", "remote", "event_type")
+	eventsDropped       = metrics.NewCounter("bs2_events_dropped_total", "Events rejected by the filter.", "remote", "event_type")
+	eventGaps           = metrics.NewCounter("bs2_event_gaps_total", "Events missing from gaps in the event index.", "remote")
+	eventIndexResets    = metrics.NewCounter("bs2_event_index_resets_total", "Times the event index went backwards.", "remote")
+	websocketReconnects = metrics.NewCounter("bs2_websocket_reconnects_total", "BioStar2 websocket reconnect attempts.", "remote")
+	authFailures        = metrics.NewCounter("bs2_auth_failures_total", "Failed BioStar2 API authentications.", "remote")
+	webhookDeliveries   = metrics.NewCounter("bs2_webhook_deliveries_total", "Webhook delivery attempts by result (delivered, retry, failed, dropped).", "webhook", "result")
+	mqttMessages        = metrics.NewCounter("bs2_mqtt_messages_total", "MQTT publish attempts by result (published, failed, dropped).", "mqtt", "result")
+	mqttReconnects      = metrics.NewCounter("bs2_mqtt_reconnects_total", "MQTT broker reconnect attempts.", "mqtt")
+	syslogMessages      = metrics.NewCounter("bs2_syslog_messages_total", "Syslog write attempts by result (sent, failed, dropped).", "syslog", "result")
+	syslogReconnects    = metrics.NewCounter("bs2_syslog_reconnects_total", "Syslog reconnect attempts.", "syslog")
+)
+
+func init() {
+	gauges := []struct {
+		name, help, label string
+		fn                func() []metrics.Sample
+	}{
+		{"bs2_webhook_queue", "Events waiting for webhook delivery.", "webhook", webhookQueueDepths},
+		{"bs2_mqtt_queue", "Events waiting to be published to MQTT.", "mqtt", mqttQueueDepths},
+		{"bs2_syslog_queue", "Events waiting to be sent to syslog.", "syslog", syslogQueueDepths},
+	}
+	for _, g := range gauges {
+		if err := metrics.NewGaugeFunc(g.name, g.help, []string{g.label}, g.fn); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/internal/pkg/metrics"
+	"bs2-evt-filter/internal/pkg/ws"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type MQTT struct {
+	name    string
+	config  config.MQTTConf
+	options *mqtt.ClientOptions
+	client  mqtt.Client
+
+	queue   chan *ws.Message
+	pending *ws.Message
+	lost    chan error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wait   *sync.WaitGroup
+}
+
+var (
+	brokers     map[string]*MQTT
+	brokersLock = new(sync.RWMutex)
+
+	topicField    = regexp.MustCompile(`\{([^{}]+)\}`)
+	topicReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+)
+
+func startMQTT(conf *config.Config) {
+	brokersLock.Lock()
+	defer brokersLock.Unlock()
+	brokers = make(map[string]*MQTT)
+	for name, mc := range conf.MQTT {
+		if m := newMQTT(name, mc); m != nil {
+			brokers[name] = m
+			m.start()
+		}
+	}
+}
+
+func reloadMQTT(conf *config.Config) {
+	brokersLock.Lock()
+	defer brokersLock.Unlock()
+	for name, m := range brokers {
+		nmc, ok := conf.MQTT[name]
+		if ok && sameMQTTConf(m.config, nmc) {
+			continue
+		}
+		m.stop()
+		delete(brokers, name)
+	}
+	for name, mc := range conf.MQTT {
+		if _, ok := brokers[name]; ok {
+			continue
+		}
+		if m := newMQTT(name, mc); m != nil {
+			brokers[name] = m
+			m.start()
+		}
+	}
+}
+
+func stopMQTT() {
+	brokersLock.Lock()
+	defer brokersLock.Unlock()
+	for _, m := range brokers {
+		m.stop()
+	}
+}
+
+func publishMQTT(msg *ws.Message) {
+	brokersLock.RLock()
+	defer brokersLock.RUnlock()
+	for _, m := range brokers {
+		m.publish(msg)
+	}
+}
+
+func mqttQueueDepths() []metrics.Sample {
+	brokersLock.RLock()
+	defer brokersLock.RUnlock()
+	var samples []metrics.Sample
+	for name, m := range brokers {
+		samples = append(samples, metrics.Sample{Labels: []string{name}, Value: float64(len(m.queue))})
+	}
+	return samples
+}
+
+func sameMQTTConf(a, b config.MQTTConf) bool {
+	if exprString(a.Filter) != exprString(b.Filter) {
+		return false
+	}
+	a.Filter, b.Filter = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+func newMQTT(name string, mc config.MQTTConf) *MQTT {
+	m := &MQTT{
+		name:   name,
+		config: mc,
+		queue:  make(chan *ws.Message, mc.QueueSize),
+		lost:   make(chan error, 1),
+		wait:   new(sync.WaitGroup),
+	}
+	tlsConfig, err := newTLSConfig(mc.TLS)
+	if err != nil {
+		m.log("tls configuration error: %v", err)
+		return nil
+	}
+	m.options = mqtt.NewClientOptions().
+		AddBroker(mc.Broker).
+		SetClientID(mc.ClientID).
+		SetUsername(mc.Username).
+		SetPassword(mc.Password).
+		SetTLSConfig(tlsConfig).
+		SetCleanSession(true).
+		SetAutoReconnect(false).
+		SetConnectTimeout(time.Duration(mc.Timeout) * time.Second).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			select {
+			case m.lost <- err:
+			default:
+			}
+		})
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	return m
+}
+
+func (m *MQTT) log(f string, v ...interface{}) {
+	log.Printf("[mqtt."+m.name+"] "+f, v...)
+}
+
+func (m *MQTT) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-m.ctx.Done():
+		return false
+	}
+}
+
+func (m *MQTT) start() {
+	m.wait.Add(1)
+	go m.run()
+}
+
+func (m *MQTT) stop() {
+	m.log("stopping")
+	m.cancel()
+	m.wait.Wait()
+	// events still queued are lost with this instance
+	dropped := len(m.queue)
+	if m.pending != nil {
+		dropped++
+	}
+	if dropped > 0 {
+		m.log("dropping %d queued events", dropped)
+		mqttMessages.Add(float64(dropped), m.name, "dropped")
+	}
+	m.log("stopped")
+}
+
+func (m *MQTT) publish(msg *ws.Message) {
+	if len(m.config.Remotes) > 0 && !m.config.Remotes[msg.Remote] {
+		return
+	}
+	if m.config.Filter != nil && !m.config.Filter.Match(msg) {
+		return
+	}
+	select {
+	case m.queue <- msg:
+	default:
+		m.log("queue full, dropping event")
+		mqttMessages.Inc(m.name, "dropped")
+	}
+}
+
+// topic expands {field} placeholders in the topic template. Values are
+// sanitized so they always form a single topic level.
+func (m *MQTT) topic(msg *ws.Message) string {
+	return topicField.ReplaceAllStringFunc(m.config.Topic, func(s string) string {
+		values := msg.Field(strings.TrimSpace(s[1 : len(s)-1]))
+		if len(values) == 0 || len(values[0]) == 0 {
+			return "unknown"
+		}
+		return topicReplacer.Replace(values[0])
+	})
+}
+
+func (m *MQTT) run() {
+	defer m.wait.Done()
+	retry := time.Duration(m.config.Retry) * time.Second
+	for {
+		m.log("connecting to %s", m.config.Broker)
+		err := m.connect()
+		if err == nil {
+			m.log("connected")
+			err = m.loop()
+			m.client.Disconnect(250)
+		}
+		if m.ctx.Err() != nil {
+			m.log("stopping main routine")
+			return
+		}
+		m.log("connection error: %v, retry in %v", err, retry)
+		if !m.sleep(retry) {
+			m.log("stopping main routine")
+			return
+		}
+		mqttReconnects.Inc(m.name)
+	}
+}
+
+func (m *MQTT) connect() error {
+	select {
+	case <-m.lost:
+	default:
+	}
+	client := mqtt.NewClient(m.options)
+	token := client.Connect()
+	if err := m.await(token, "connect"); err != nil {
+		// the client cannot be disconnected while connecting, leave the
+		// attempt to finish and disconnect it if it still succeeds
+		go func() {
+			if token.Wait() && token.Error() == nil {
+				client.Disconnect(0)
+			}
+		}()
+		return err
+	}
+	m.client = client
+	return nil
+}
+
+// await waits for a token to complete, giving up after the timeout or when
+// the instance is stopped, so a stop never waits for an unresponsive broker.
+func (m *MQTT) await(token mqtt.Token, op string) error {
+	done := make(chan bool, 1)
+	go func() {
+		done <- token.WaitTimeout(time.Duration(m.config.Timeout) * time.Second)
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			return errors.New(op + " timeout")
+		}
+		return token.Error()
+	case <-m.ctx.Done():
+		return m.ctx.Err()
+	}
+}
+
+// loop publishes queued events until the connection is lost. An event that
+// failed to publish is kept and sent first after reconnecting.
+func (m *MQTT) loop() error {
+	for {
+		msg := m.pending
+		if msg == nil {
+			select {
+			case msg = <-m.queue:
+			case err := <-m.lost:
+				return err
+			case <-m.ctx.Done():
+				return nil
+			}
+		}
+		m.pending = msg
+		token := m.client.Publish(m.topic(msg), byte(m.config.QoS), m.config.Retain, msg.Data)
+		if err := m.await(token, "publish"); err != nil {
+			if m.ctx.Err() != nil {
+				// stopped, the event is counted as dropped by stop
+				return nil
+			}
+			mqttMessages.Inc(m.name, "failed")
+			return err
+		}
+		m.pending = nil
+		mqttMessages.Inc(m.name, "published")
+	}
+}
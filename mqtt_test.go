@@ -0,0 +1,261 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/internal/pkg/ws"
+	"bs2-evt-filter/pkg/biostar2"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+const testTopic = "bs2/{remote}/{device.id}/{event_type.code}"
+
+func testMessage(t *testing.T, remote string, data string) *ws.Message {
+	e, ok := biostar2.ParseEvent([]byte(data))
+	if !ok {
+		t.Fatalf("invalid event: %s", data)
+	}
+	return &ws.Message{Remote: remote, Event: e, Data: []byte(data)}
+}
+
+func testMQTT(t *testing.T, name string, mc config.MQTTConf) *MQTT {
+	if mc.Timeout == 0 {
+		mc.Timeout = 2
+	}
+	if mc.Retry == 0 {
+		mc.Retry = 1
+	}
+	if mc.QueueSize == 0 {
+		mc.QueueSize = 10
+	}
+	m := newMQTT(name, mc)
+	if m == nil {
+		t.Fatal("newMQTT failed")
+	}
+	return m
+}
+
+func TestMQTTTopic(t *testing.T) {
+	const event = `{"Event":{"index":"1","device_id":{"id":"541"},"event_type_id":{"code":"4865"},"user_id":{"user_id":"a/b+c#d"}}}`
+	tests := []struct {
+		topic string
+		want  string
+	}{
+		{testTopic, "bs2/local/541/4865"},
+		{"events/{remote}", "events/local"},
+		{"{ device.id }/{event_type.code}", "541/4865"},
+		{"users/{user.id}", "users/a_b_c_d"},
+		{"doors/{door.id}", "doors/unknown"},
+		{"{no.such.field}", "unknown"},
+		{"static/topic", "static/topic"},
+		{"{device.id}{event_type.code}", "5414865"},
+		{"{}/{remote}", "{}/local"},
+	}
+	msg := testMessage(t, "local", event)
+	for _, tt := range tests {
+		t.Run(tt.topic, func(t *testing.T) {
+			m := testMQTT(t, "topic", config.MQTTConf{Broker: "tcp://127.0.0.1:1", Topic: tt.topic})
+			if got := m.topic(msg); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMQTTQueueFull(t *testing.T) {
+	const name = "queue-full"
+	m := testMQTT(t, name, config.MQTTConf{Broker: "tcp://127.0.0.1:1", Topic: testTopic, QueueSize: 2})
+	msg := testMessage(t, "local", `{"Event":{"index":"1","device_id":{"id":"541"}}}`)
+	dropped := mqttMessages.Value(name, "dropped")
+	for i := 0; i < 5; i++ {
+		m.publish(msg)
+	}
+	if n := len(m.queue); n != 2 {
+		t.Errorf("got %d queued events, want 2", n)
+	}
+	if n := mqttMessages.Value(name, "dropped") - dropped; n != 3 {
+		t.Errorf("got %v dropped events, want 3", n)
+	}
+	// queued events are dropped when the instance is replaced
+	m.stop()
+	if n := mqttMessages.Value(name, "dropped") - dropped; n != 5 {
+		t.Errorf("got %v dropped events after stop, want 5", n)
+	}
+}
+
+// broker is a minimal MQTT broker accepting QoS 0 publishes. It closes the
+// first connection after its first publish.
+type broker struct {
+	ln       net.Listener
+	lock     sync.Mutex
+	connects int
+	topics   []string
+	changed  chan struct{}
+}
+
+func newBroker(t *testing.T) *broker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{ln: ln, changed: make(chan struct{}, 16)}
+	go b.serve()
+	return b
+}
+
+func (b *broker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *broker) handle(conn net.Conn) {
+	defer conn.Close()
+	p, err := packets.ReadPacket(conn)
+	if err != nil {
+		return
+	}
+	if _, ok := p.(*packets.ConnectPacket); !ok {
+		return
+	}
+	if err := packets.NewControlPacket(packets.Connack).Write(conn); err != nil {
+		return
+	}
+	b.lock.Lock()
+	b.connects++
+	first := b.connects == 1
+	b.lock.Unlock()
+	b.changed <- struct{}{}
+	for {
+		p, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := p.(type) {
+		case *packets.PublishPacket:
+			b.lock.Lock()
+			b.topics = append(b.topics, p.TopicName)
+			b.lock.Unlock()
+			b.changed <- struct{}{}
+			if first {
+				return
+			}
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *broker) state() (int, []string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.connects, append([]string(nil), b.topics...)
+}
+
+func (b *broker) waitFor(t *testing.T, connects int, topics int) []string {
+	timeout := time.After(5 * time.Second)
+	for {
+		c, tps := b.state()
+		if c >= connects && len(tps) >= topics {
+			return tps
+		}
+		select {
+		case <-b.changed:
+		case <-timeout:
+			t.Fatalf("got %d connects and topics %v, want %d connects and %d topics", c, tps, connects, topics)
+		}
+	}
+}
+
+// TestMQTTStopUnresponsive checks that stopping does not wait for the
+// timeout of a broker that never answers.
+func TestMQTTStopUnresponsive(t *testing.T) {
+	tests := []struct {
+		name    string
+		connack bool
+	}{
+		{"connect", false},
+		{"publish", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			accepted := make(chan struct{}, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				packets.ReadPacket(conn)
+				if tt.connack {
+					packets.NewControlPacket(packets.Connack).Write(conn)
+				}
+				accepted <- struct{}{}
+				for {
+					if _, err := packets.ReadPacket(conn); err != nil {
+						return
+					}
+				}
+			}()
+			m := testMQTT(t, "unresponsive-"+tt.name, config.MQTTConf{
+				Broker:   "tcp://" + ln.Addr().String(),
+				ClientID: "test",
+				Topic:    testTopic,
+				QoS:      1,
+				Timeout:  30,
+			})
+			m.start()
+			<-accepted
+			if tt.connack {
+				m.publish(testMessage(t, "local", `{"Event":{"index":"1","device_id":{"id":"541"}}}`))
+				time.Sleep(100 * time.Millisecond)
+			}
+			start := time.Now()
+			m.stop()
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("stop took %v", d)
+			}
+		})
+	}
+}
+
+func TestMQTTReconnect(t *testing.T) {
+	const name = "reconnect"
+	b := newBroker(t)
+	defer b.ln.Close()
+	m := testMQTT(t, name, config.MQTTConf{
+		Broker:   "tcp://" + b.ln.Addr().String(),
+		ClientID: "test",
+		Topic:    "events/{index}",
+	})
+	reconnects := mqttReconnects.Value(name)
+	m.start()
+	defer m.stop()
+
+	b.waitFor(t, 1, 0)
+	m.publish(testMessage(t, "local", `{"Event":{"index":"1","device_id":{"id":"541"}}}`))
+	b.waitFor(t, 2, 1)
+	m.publish(testMessage(t, "local", `{"Event":{"index":"2","device_id":{"id":"541"}}}`))
+	topics := b.waitFor(t, 2, 2)
+	if topics[0] != "events/1" || topics[len(topics)-1] != "events/2" {
+		t.Errorf("got topics %v, want events/1 and events/2", topics)
+	}
+	if n := mqttReconnects.Value(name) - reconnects; n != 1 {
+		t.Errorf("got %v reconnects, want 1", n)
+	}
+}
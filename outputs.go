@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/internal/pkg/ws"
+	"bs2-evt-filter/pkg/biostar2"
+	"bs2-evt-filter/pkg/expr"
+)
+
+// outputs receive filtered events in addition to websocket clients.
+
+func startOutputs(conf *config.Config) {
+	startWebhooks(conf)
+	startMQTT(conf)
+	startSyslog(conf)
+}
+
+func reloadOutputs(conf *config.Config) {
+	reloadWebhooks(conf)
+	reloadMQTT(conf)
+	reloadSyslog(conf)
+}
+
+func stopOutputs() {
+	stopWebhooks()
+	stopMQTT()
+	stopSyslog()
+}
+
+func publish(remote string, e *biostar2.Event, data []byte) {
+	m := &ws.Message{Remote: remote, Event: e, Data: data}
+	publishWebhooks(m)
+	publishMQTT(m)
+	publishSyslog(m)
+}
+
+func exprString(e *expr.Expr) string {
+	if e == nil {
+		return ""
+	}
+	return e.String()
+}
@@ -9,170 +9,267 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-func NewAPI(url string, username string, password string) *API {
+const (
+	OperatorEqual = iota
+	OperatorNotEqual
+	OperatorContains
+	OperatorBetween
+	OperatorLike
+	OperatorGreater
+	OperatorLess
+)
+
+const (
+	defaultTimeout = 7 * time.Second
+	loginUrl       = "/api/login"
+)
+
+func NewAPI(url string, username string, password string, opts ...Option) *API {
 	b := &API{url: url, username: username, password: password}
-	b.authorized = false
+	b.timeout = defaultTimeout
+	b.tlsConfig = new(tls.Config)
+	b.proxy = http.ProxyFromEnvironment
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.client == nil {
+		b.client = &http.Client{Transport: &http.Transport{
+			Proxy:               b.proxy,
+			TLSClientConfig:     b.tlsConfig,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}}
+	}
+	b.lock = new(sync.Mutex)
 	b.sessionID = ""
 	return b
 }
 
+func (b *API) Close() {
+	if tr, ok := b.client.Transport.(*http.Transport); ok {
+		tr.CloseIdleConnections()
+	}
+}
+
 func (b *API) SessionID() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
 	return b.sessionID
 }
 
+func (b *API) setSessionID(sid string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.sessionID = sid
+}
+
 func (r *API) log(f string, v ...interface{}) {
 	log.Printf("[b2api] "+f, v...)
 }
 
-func (b *API) doHttpRequest(req *http.Request) (*http.Response, bool) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+func (b *API) httpError(apiUrl string, resp *http.Response, body []byte) error {
+	if resp.StatusCode == http.StatusUnauthorized {
+		if apiUrl == loginUrl {
+			return ErrUnauthorized
+		}
+		return ErrSessionExpired
 	}
-	client := &http.Client{Transport: tr}
-	resp, err := client.Do(req)
-	if err != nil {
-		b.log("http.client failed with: %v", err)
-		return nil, false
+	e := &APIError{Status: resp.StatusCode}
+	if r, ok := ParseResponse(body); ok {
+		e.Code = r.Code
+		e.Message = r.Message
 	}
-	return resp, true
+	return e
 }
 
-func (b *API) getHttpRequest(apiUrl string, data []byte) (*http.Request, context.CancelFunc) {
-	url := fmt.Sprintf("%s%s", strings.TrimRight(b.url, "/"), apiUrl)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
+func (b *API) call(ctx context.Context, method string, apiUrl string, in interface{}, out interface{}) (http.Header, error) {
+	var data []byte
+	if in != nil {
+		var err error
+		data, err = json.Marshal(in)
+		if err != nil {
+			return nil, fmt.Errorf("biostar2: encoding request: %v", err)
+		}
+	}
+	reqUrl := fmt.Sprintf("%s%s", strings.TrimRight(b.url, "/"), apiUrl)
+	req, err := http.NewRequest(method, reqUrl, bytes.NewBuffer(data))
 	if err != nil {
-		b.log("http.request failed with: %v", err)
-		return nil, nil
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*7)
+	if len(b.userAgent) > 0 {
+		req.Header.Set("User-Agent", b.userAgent)
+	}
+	if apiUrl != loginUrl {
+		req.Header.Set("bs-session-id", b.SessionID())
+	}
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
 	req = req.WithContext(ctx)
-	return req, cancel
-}
 
-func (b *API) logHttpFailure(resp *http.Response) {
-	body, _ := ioutil.ReadAll(resp.Body)
-	r, ok := ParseResponse(body)
-	s := strings.TrimSpace(resp.Status)
-	if ok {
-		b.log("error, status: %s, code: %s, msg: %s", s, r.Code, r.Message)
-	} else {
-		b.log("error, status: %s", s)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, b.httpError(apiUrl, resp, body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return nil, fmt.Errorf("biostar2: decoding response: %v", err)
+		}
 	}
+	return resp.Header, nil
 }
-func (b *API) Auth() bool {
-	b.sessionID = ""
+
+func (b *API) Auth(ctx context.Context) error {
+	b.setSessionID("")
 	uw := &UserAuthWrapper{UserAuth{Username: b.username, Password: b.password}}
-	j, err := json.Marshal(uw)
+	hdr, err := b.call(ctx, "POST", loginUrl, uw, nil)
 	if err != nil {
-		b.log("json.marshal failed with: %v", err)
-		return false
+		return err
 	}
-	req, cancel := b.getHttpRequest("/api/login", j)
-	if cancel == nil {
-		return false
+	sid := hdr.Get("Bs-Session-Id")
+	if len(sid) == 0 {
+		return ErrNoSession
 	}
-	defer cancel()
-	resp, ok := b.doHttpRequest(req)
-	if !ok {
-		return false
+	b.setSessionID(sid)
+	b.log("session retrieved successfuly\n")
+	return nil
+}
+
+func (b *API) StartEvents(ctx context.Context) error {
+	_, err := b.call(ctx, "POST", "/api/events/start", nil, nil)
+	if err != nil {
+		return err
 	}
-	defer resp.Body.Close()
+	b.log("events started")
+	return nil
+}
 
-	if resp.StatusCode == 200 {
-		hv, ok := resp.Header["Bs-Session-Id"]
-		if ok && len(hv) > 0 {
-			b.sessionID = hv[0]
-			b.log("session retrieved successfuly\n")
-			return true
-		}
-		b.log("session id not found")
-		return false
-	} else {
-		b.logHttpFailure(resp)
-		return false
+func (b *API) SearchEvents(ctx context.Context, after string, limit int) ([]json.RawMessage, error) {
+	q := &EventQueryWrapper{EventQuery{
+		Limit: limit,
+		Conditions: []QueryCondition{
+			{Column: "index", Operator: OperatorGreater, Values: []string{after}},
+		},
+		Orders: []QueryOrder{{Column: "index", Descending: false}},
+	}}
+	var w EventCollectionWrapper
+	if _, err := b.call(ctx, "POST", "/api/events/search", q, &w); err != nil {
+		return nil, err
 	}
+	return w.EventCollection.Rows, nil
 }
 
-func (b *API) StartEvents() bool {
-	req, cancel := b.getHttpRequest("/api/events/start", []byte(""))
-	if cancel == nil {
-		return false
+func (b *API) EventTypes(ctx context.Context) ([]EventType, error) {
+	var w EventTypeCollectionWrapper
+	if _, err := b.call(ctx, "GET", "/api/event_types", nil, &w); err != nil {
+		return nil, err
 	}
-	defer cancel()
-	req.Header.Set("bs-session-id", b.sessionID)
-	resp, ok := b.doHttpRequest(req)
-	if !ok {
-		return false
+	return w.EventTypeCollection.Rows, nil
+}
+
+func (b *API) GetUser(ctx context.Context, id string) (*UserInfo, error) {
+	var w UserInfoWrapper
+	if _, err := b.call(ctx, "GET", "/api/users/"+url.PathEscape(id), nil, &w); err != nil {
+		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 200 {
-		b.log("events started")
-		return true
-	} else {
-		b.logHttpFailure(resp)
-		return false
+	return &w.User, nil
+}
+
+func (b *API) GetDevice(ctx context.Context, id string) (*DeviceInfo, error) {
+	var w DeviceInfoWrapper
+	if _, err := b.call(ctx, "GET", "/api/devices/"+url.PathEscape(id), nil, &w); err != nil {
+		return nil, err
+	}
+	return &w.Device, nil
+}
+
+func (b *API) GetDoor(ctx context.Context, id string) (*DoorInfo, error) {
+	var w DoorInfoWrapper
+	if _, err := b.call(ctx, "GET", "/api/doors/"+url.PathEscape(id), nil, &w); err != nil {
+		return nil, err
 	}
+	return &w.Door, nil
 }
 
 func (b *API) wslog(f string, v ...interface{}) {
 	log.Printf("[b2wsapi] "+f, v...)
 }
 
-func (b *API) WebSocket(recv chan<- []byte, send <-chan []byte, done <-chan struct{}) {
-	url := fmt.Sprintf("%s/wsapi", strings.TrimRight(b.url, "/"))
-	url = strings.Replace(url, "http", "ws", 1)
+func (b *API) WebSocket(ctx context.Context, recv chan<- []byte, send <-chan []byte) error {
+	wsUrl := fmt.Sprintf("%s/wsapi", strings.TrimRight(b.url, "/"))
+	wsUrl = strings.Replace(wsUrl, "http", "ws", 1)
 
-	b.wslog("connecting to %s", url)
-	dialer := websocket.DefaultDialer
-	dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	c, _, err := dialer.Dial(url, nil)
+	b.wslog("connecting to %s", wsUrl)
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = b.tlsConfig
+	dialer.Proxy = b.proxy
+	hdr := make(http.Header)
+	if len(b.userAgent) > 0 {
+		hdr.Set("User-Agent", b.userAgent)
+	}
+	c, _, err := dialer.DialContext(ctx, wsUrl, hdr)
 	if err != nil {
-		b.wslog("connection error: %v", err)
-		return
+		return err
 	}
-	b.wslog("connected to %s\n", url)
+	b.wslog("connected to %s\n", wsUrl)
 	defer c.Close()
 
 	rdone := make(chan struct{})
+	var rerr error
 	go func() {
 		defer close(rdone)
 		for {
 			_, message, err := c.ReadMessage()
 			if err != nil {
-				b.wslog("read error: %v", err)
+				rerr = err
 				return
 			}
 			message = bytes.TrimSpace(message)
-			recv <- message
+			select {
+			case recv <- message:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	for {
 		select {
 		case msg := <-send:
-			c.WriteMessage(websocket.TextMessage, msg)
+			if err := c.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return err
+			}
 		case <-rdone:
 			b.wslog("disconnect (read)")
-			return
-		case <-done:
+			return rerr
+		case <-ctx.Done():
 			b.wslog("disconnect (done)")
 			err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 			if err != nil {
-				b.wslog("write error: %v", err)
-				return
+				return err
 			}
 			select {
 			case <-rdone:
 			case <-time.After(time.Second):
 			}
-			return
+			return nil
 		}
 	}
 }
@@ -0,0 +1,55 @@
+package biostar2
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+type EventTypeCatalog struct {
+	types  []EventType
+	byName map[string]string
+	byCode map[string]string
+}
+
+func NewEventTypeCatalog(types []EventType) *EventTypeCatalog {
+	c := &EventTypeCatalog{
+		types:  types,
+		byName: make(map[string]string),
+		byCode: make(map[string]string),
+	}
+	for _, t := range types {
+		if len(t.Name) > 0 && len(t.Code) > 0 {
+			c.byName[strings.ToUpper(t.Name)] = t.Code
+			c.byCode[t.Code] = t.Name
+		}
+	}
+	return c
+}
+
+func (c *EventTypeCatalog) Types() []EventType {
+	return c.types
+}
+
+// Name returns the name of the event type with the given code, or an empty
+// string if the code is unknown.
+func (c *EventTypeCatalog) Name(code string) string {
+	return c.byCode[code]
+}
+
+// Resolve returns the codes of all event types whose name matches pattern.
+// Patterns are case-insensitive and may use shell wildcards, e.g. IDENTIFY_FAIL_*.
+func (c *EventTypeCatalog) Resolve(pattern string) []string {
+	pattern = strings.ToUpper(pattern)
+	if code, ok := c.byName[pattern]; ok {
+		return []string{code}
+	}
+	var codes []string
+	for name, code := range c.byName {
+		if ok, _ := path.Match(pattern, name); ok {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	return codes
+}
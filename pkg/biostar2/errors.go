@@ -0,0 +1,25 @@
+package biostar2
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnauthorized   = errors.New("biostar2: unauthorized")
+	ErrSessionExpired = errors.New("biostar2: session expired")
+	ErrNoSession      = errors.New("biostar2: session id not found")
+)
+
+type APIError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	if len(e.Code) > 0 {
+		return fmt.Sprintf("biostar2: status: %d, code: %s, msg: %s", e.Status, e.Code, e.Message)
+	}
+	return fmt.Sprintf("biostar2: status: %d", e.Status)
+}
@@ -0,0 +1,69 @@
+package biostar2
+
+func fieldValues(v ...string) []string {
+	values := make([]string, 0, len(v))
+	for _, s := range v {
+		if len(s) > 0 {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+func (e *Event) Field(name string) []string {
+	switch name {
+	case "id":
+		return fieldValues(string(e.ID))
+	case "datetime":
+		return fieldValues(e.Datetime)
+	case "server_datetime":
+		return fieldValues(e.ServerDatetime)
+	case "index":
+		return fieldValues(e.Index)
+	case "tna_key":
+		return fieldValues(string(e.TNAKey))
+	case "hint":
+		return fieldValues(string(e.Hint))
+	case "parameter":
+		return fieldValues(string(e.Parameter))
+	case "temperature":
+		return fieldValues(string(e.Temperature))
+	case "image_id":
+		return fieldValues(string(e.ImageID))
+	case "event_type.code":
+		return fieldValues(e.EventType.Code)
+	case "event_type.name":
+		return fieldValues(e.EventType.Name)
+	case "device.id":
+		return fieldValues(e.Device.ID)
+	case "device.name":
+		return fieldValues(e.Device.Name)
+	case "user.id":
+		return fieldValues(e.User.ID)
+	case "user.name":
+		return fieldValues(e.User.Name)
+	case "user.department":
+		return fieldValues(e.User.Department)
+	case "user_group.id":
+		return fieldValues(e.UserGroup.ID)
+	case "user_group.name":
+		return fieldValues(e.UserGroup.Name)
+	case "door.id":
+		return fieldValues(e.Doors.IDs()...)
+	case "door.name":
+		values := make([]string, 0, len(e.Doors))
+		for _, d := range e.Doors {
+			values = append(values, d.Name)
+		}
+		return fieldValues(values...)
+	}
+	return nil
+}
+
+func (d Doors) IDs() []string {
+	ids := make([]string, 0, len(d))
+	for _, door := range d {
+		ids = append(ids, door.ID)
+	}
+	return ids
+}
@@ -1,11 +1,25 @@
 package biostar2
 
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
 type API struct {
-	url        string
-	username   string
-	password   string
-	authorized bool
-	sessionID  string
+	url       string
+	username  string
+	password  string
+	timeout   time.Duration
+	tlsConfig *tls.Config
+	userAgent string
+	proxy     func(*http.Request) (*url.URL, error)
+	client    *http.Client
+	lock      *sync.Mutex
+	sessionID string
 }
 
 type UserAuthWrapper struct {
@@ -28,28 +42,136 @@ type Response struct {
 }
 
 type EventWrapper struct {
-	Event Event `json:"Event"`
+	Event    Event `json:"Event"`
+	Backfill bool  `json:"backfill,omitempty"`
 }
 
 type Event struct {
-	EventType EventType `json:"event_type_id"`
-	Index     string    `json:"index"`
-	Device    Device    `json:"device_id"`
-	User      User      `json:"user_id,omitempty"`
+	ID                 Value           `json:"id,omitempty"`
+	Datetime           string          `json:"datetime,omitempty"`
+	ServerDatetime     string          `json:"server_datetime,omitempty"`
+	EventType          EventType       `json:"event_type_id"`
+	Index              string          `json:"index"`
+	Device             Device          `json:"device_id"`
+	User               User            `json:"user_id,omitempty"`
+	UserGroup          UserGroup       `json:"user_group_id,omitempty"`
+	Doors              Doors           `json:"door_id,omitempty"`
+	TNAKey             Value           `json:"tna_key,omitempty"`
+	Hint               Value           `json:"hint,omitempty"`
+	Parameter          Value           `json:"parameter,omitempty"`
+	Temperature        Value           `json:"temperature,omitempty"`
+	ImageID            Value           `json:"image_id,omitempty"`
+	UserUpdateByDevice Value           `json:"user_update_by_device,omitempty"`
+	IsDST              Value           `json:"is_dst,omitempty"`
+	Timezone           Timezone        `json:"timezone,omitempty"`
+	Backfill           bool            `json:"-"`
+	Raw                json.RawMessage `json:"-"`
 }
 
-type EventType struct {
-	Code string `json:"code"`
+// Value holds a scalar that BioStar2 may send either as a string or as a
+// number or boolean; objects and arrays are kept as raw JSON text.
+type Value string
+
+type Timezone struct {
+	Half     Value `json:"half"`
+	Hour     Value `json:"hour"`
+	Negative Value `json:"negative"`
+}
+
+type UserInfoWrapper struct {
+	User UserInfo `json:"User"`
+}
+
+type UserInfo struct {
+	ID         string    `json:"user_id"`
+	Name       string    `json:"name"`
+	Department string    `json:"department,omitempty"`
+	Title      string    `json:"title,omitempty"`
+	Email      string    `json:"email,omitempty"`
+	UserGroup  UserGroup `json:"user_group_id,omitempty"`
+}
+
+type DeviceInfoWrapper struct {
+	Device DeviceInfo `json:"Device"`
+}
+
+type DeviceInfo struct {
+	ID   string `json:"id"`
 	Name string `json:"name"`
-	// Description string `json:"description"`
 }
 
-type User struct {
-	ID   string `json:"user_id"`
+type DoorInfoWrapper struct {
+	Door DoorInfo `json:"Door"`
+}
+
+type DoorInfo struct {
+	ID   string `json:"id"`
 	Name string `json:"name"`
 }
 
+type EventQueryWrapper struct {
+	Query EventQuery `json:"Query"`
+}
+
+type EventQuery struct {
+	Limit      int              `json:"limit"`
+	Conditions []QueryCondition `json:"conditions,omitempty"`
+	Orders     []QueryOrder     `json:"orders,omitempty"`
+}
+
+type QueryCondition struct {
+	Column   string   `json:"column"`
+	Operator int      `json:"operator"`
+	Values   []string `json:"values"`
+}
+
+type QueryOrder struct {
+	Column     string `json:"column"`
+	Descending bool   `json:"descending"`
+}
+
+type EventCollectionWrapper struct {
+	EventCollection EventCollection `json:"EventCollection"`
+}
+
+type EventCollection struct {
+	Rows []json.RawMessage `json:"rows"`
+}
+
+type EventType struct {
+	Code        string `json:"code"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type EventTypeCollectionWrapper struct {
+	EventTypeCollection EventTypeCollection `json:"EventTypeCollection"`
+}
+
+type EventTypeCollection struct {
+	Rows []EventType `json:"rows"`
+}
+
+type User struct {
+	ID          string `json:"user_id"`
+	Name        string `json:"name"`
+	Department  string `json:"department,omitempty"`
+	PhotoExists Value  `json:"photo_exists,omitempty"`
+}
+
 type Device struct {
 	ID   string `json:"id"`
 	Name string `json:"name"`
 }
+
+type UserGroup struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type Door struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type Doors []Door
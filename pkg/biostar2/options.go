@@ -0,0 +1,33 @@
+package biostar2
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type Option func(b *API)
+
+// WithHTTPClient replaces the pooled client built by NewAPI. The client's
+// transport is used as is; TLS and proxy options then only apply to the
+// websocket connection.
+func WithHTTPClient(c *http.Client) Option {
+	return func(b *API) { b.client = c }
+}
+
+func WithTLSConfig(c *tls.Config) Option {
+	return func(b *API) { b.tlsConfig = c }
+}
+
+func WithTimeout(d time.Duration) Option {
+	return func(b *API) { b.timeout = d }
+}
+
+func WithUserAgent(ua string) Option {
+	return func(b *API) { b.userAgent = ua }
+}
+
+func WithProxy(u *url.URL) Option {
+	return func(b *API) { b.proxy = http.ProxyURL(u) }
+}
@@ -1,9 +1,14 @@
 package biostar2
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
+	"time"
 )
 
+const datetimeLayout = time.RFC3339Nano
+
 func ParseResponse(data []byte) (*Response, bool) {
 	var w ResponseWrapper
 	err := json.Unmarshal(data, &w)
@@ -18,8 +23,63 @@ func ParseEvent(data []byte) (*Event, bool) {
 	var w EventWrapper
 	err := json.Unmarshal(data, &w)
 	if err == nil && len(w.Event.Device.ID) > 0 {
+		var raw struct {
+			Event json.RawMessage `json:"Event"`
+		}
+		if json.Unmarshal(data, &raw) == nil {
+			w.Event.Raw = raw.Event
+		}
+		w.Event.Backfill = w.Backfill
 		return &w.Event, true
 	} else {
 		return nil, false
 	}
 }
+
+func (e *Event) Time() (time.Time, error) {
+	return time.Parse(datetimeLayout, e.Datetime)
+}
+
+func (e *Event) ServerTime() (time.Time, error) {
+	return time.Parse(datetimeLayout, e.ServerDatetime)
+}
+
+func (v *Value) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		*v = ""
+	case len(data) > 0 && data[0] == '"':
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*v = Value(s)
+	default:
+		*v = Value(data)
+	}
+	return nil
+}
+
+func (v Value) String() string {
+	return string(v)
+}
+
+func (d *Doors) UnmarshalJSON(data []byte) error {
+	var doors []Door
+	if err := json.Unmarshal(data, &doors); err == nil {
+		*d = doors
+		return nil
+	}
+	var door Door
+	if err := json.Unmarshal(data, &door); err != nil {
+		return err
+	}
+	*d = Doors{door}
+	return nil
+}
+
+func (e *Event) String() string {
+	return fmt.Sprintf("{index: %s, datetime: %s, event_type: %s, device: %s, user: %s}",
+		e.Index, e.Datetime, e.EventType.Code, e.Device.ID, e.User.ID)
+}
@@ -0,0 +1,38 @@
+package biostar2
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDoors(t *testing.T) {
+	tests := []struct {
+		name  string
+		doors string
+		ok    bool
+		want  []string
+	}{
+		{"object", `,"door_id":{"id":"10","name":"front"}`, true, []string{"10"}},
+		{"array", `,"door_id":[{"id":"11"},{"id":"12"}]`, true, []string{"11", "12"}},
+		{"single element array", `,"door_id":[{"id":"13"}]`, true, []string{"13"}},
+		{"empty array", `,"door_id":[]`, true, []string{}},
+		{"null", `,"door_id":null`, true, []string{}},
+		{"missing", ``, true, []string{}},
+		{"invalid", `,"door_id":"10"`, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := `{"Event":{"index":"1","device_id":{"id":"541"}` + tt.doors + `}}`
+			e, ok := ParseEvent([]byte(data))
+			if ok != tt.ok {
+				t.Fatalf("got ok %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if got := e.Doors.IDs(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got door ids %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Package expr implements a small boolean expression language used to
+// filter events, e.g.
+//
+//	device.id in ["123"] && !(event_type.code == "4865") || user.id startsWith "9"
+//
+// Comparisons are ==, !=, in, startsWith, endsWith, contains and matches
+// (regular expression). They can be combined with &&, ||, ! and parentheses.
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	opEqual      = "=="
+	opStartsWith = "startsWith"
+	opEndsWith   = "endsWith"
+	opContains   = "contains"
+	opMatches    = "matches"
+)
+
+// Fields resolves a field name to its values. A comparison matches if any
+// of the returned values matches; unknown fields return no values.
+type Fields interface {
+	Field(name string) []string
+}
+
+type Expr struct {
+	src  string
+	root node
+}
+
+func Compile(s string) (*Expr, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, fmt.Errorf("expr: %v", err)
+	}
+	root, err := parse(tokens)
+	if err != nil {
+		return nil, fmt.Errorf("expr: %v", err)
+	}
+	return &Expr{src: s, root: root}, nil
+}
+
+func (e *Expr) Match(f Fields) bool {
+	return e.root.eval(f)
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+type node interface {
+	eval(f Fields) bool
+}
+
+type orNode struct {
+	left, right node
+}
+
+func (n *orNode) eval(f Fields) bool {
+	return n.left.eval(f) || n.right.eval(f)
+}
+
+type andNode struct {
+	left, right node
+}
+
+func (n *andNode) eval(f Fields) bool {
+	return n.left.eval(f) && n.right.eval(f)
+}
+
+type notNode struct {
+	n node
+}
+
+func (n *notNode) eval(f Fields) bool {
+	return !n.n.eval(f)
+}
+
+type inNode struct {
+	field  string
+	values map[string]bool
+}
+
+func (n *inNode) eval(f Fields) bool {
+	for _, v := range f.Field(n.field) {
+		if n.values[v] {
+			return true
+		}
+	}
+	return false
+}
+
+type cmpNode struct {
+	field string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (n *cmpNode) eval(f Fields) bool {
+	for _, v := range f.Field(n.field) {
+		if n.match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *cmpNode) match(v string) bool {
+	switch n.op {
+	case opEqual:
+		return v == n.value
+	case opStartsWith:
+		return strings.HasPrefix(v, n.value)
+	case opEndsWith:
+		return strings.HasSuffix(v, n.value)
+	case opContains:
+		return strings.Contains(v, n.value)
+	case opMatches:
+		return n.re.MatchString(v)
+	}
+	return false
+}
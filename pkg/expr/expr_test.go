@@ -0,0 +1,143 @@
+package expr
+
+import (
+	"testing"
+)
+
+type fields map[string][]string
+
+func (f fields) Field(name string) []string {
+	return f[name]
+}
+
+var event = fields{
+	"a":     {"1"},
+	"b":     {"2"},
+	"c":     {"3"},
+	"name":  {"front door"},
+	"quote": {`say "hi"`},
+	"multi": {"x", "y"},
+	"text":  {"tab\there", "line\nbreak", `back\slash`, "it's"},
+}
+
+func TestPrecedence(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`a == "1" || a == "2" && b == "9"`, true},
+		{`(a == "1" || a == "2") && b == "9"`, false},
+		{`a == "9" && b == "2" || c == "3"`, true},
+		{`a == "9" && (b == "2" || c == "3")`, false},
+		{`!a == "1" || b == "2"`, true},
+		{`!(a == "1" || b == "2")`, false},
+		{`!a == "9" && !b == "9"`, true},
+		{`!!a == "1"`, true},
+		{`a != "1" || b != "2" || c == "3"`, true},
+		{`a != "1" || b != "2" && c == "3"`, false},
+		{`((a == "1"))`, true},
+		{`a == 1 && b == 2`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := Compile(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e.Match(event); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIn(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`a in ["1"]`, true},
+		{`a in ["2", "3"]`, false},
+		{`a in ["3", "2", "1"]`, true},
+		{`a in [1, 2]`, true},
+		{`a in []`, false},
+		{`missing in ["1"]`, false},
+		{`multi in ["y"]`, true},
+		{`multi in ["z"]`, false},
+		{`!a in ["1"]`, false},
+		{`name in ['front door']`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := Compile(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e.Match(event); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`quote == "say \"hi\""`, true},
+		{`quote == 'say "hi"'`, true},
+		{`text == "tab\there"`, true},
+		{`text == "line\nbreak"`, true},
+		{`text == "back\\slash"`, true},
+		{`text == 'it\'s'`, true},
+		{`text == "it's"`, true},
+		{`text == "back\\\\slash"`, false},
+		{`name matches "^front\\s"`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := Compile(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e.Match(event); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{``, `expr: expected field name, got end of expression at offset 0`},
+		{`a = "1"`, `expr: unexpected '=' at offset 2`},
+		{`a == "1" & b == "2"`, `expr: unexpected '&' at offset 9`},
+		{`a == "1" | b == "2"`, `expr: unexpected '|' at offset 9`},
+		{`a == "1`, `expr: unterminated string at offset 5`},
+		{`a == "\x"`, `expr: invalid escape \x in string at offset 5`},
+		{`a == "1" b`, `expr: unexpected "b" at offset 9`},
+		{`(a == "1"`, `expr: expected ')', got end of expression at offset 9`},
+		{`a == "1")`, `expr: unexpected ")" at offset 8`},
+		{`a in ["1" "2"]`, `expr: expected ',' or ']', got "2" at offset 10`},
+		{`a in ["1",]`, `expr: expected value, got "]" at offset 10`},
+		{`a == b`, `expr: expected value, got "b" at offset 5`},
+		{`a # "1"`, `expr: unexpected '#' at offset 2`},
+		{`a == "1" && `, `expr: expected field name, got end of expression at offset 12`},
+		{`ä == "1" && § `, `expr: unexpected '§' at offset 12`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := Compile(tt.expr)
+			if err == nil {
+				t.Fatal("compiled without error")
+			}
+			if err.Error() != tt.want {
+				t.Errorf("got error %q, want %q", err, tt.want)
+			}
+		})
+	}
+}
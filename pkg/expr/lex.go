@@ -0,0 +1,138 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokAnd
+	tokOr
+	tokNot
+	tokEq
+	tokNe
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || r == '.' || r == '-' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokRParen, ")", i})
+			i++
+		case r == '[':
+			tokens = append(tokens, token{tokLBracket, "[", i})
+			i++
+		case r == ']':
+			tokens = append(tokens, token{tokRBracket, "]", i})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{tokComma, ",", i})
+			i++
+		case r == '&' || r == '|' || r == '=':
+			if i+1 >= len(rs) || rs[i+1] != r {
+				return nil, fmt.Errorf("unexpected %q at offset %d", r, i)
+			}
+			kind := map[rune]tokenKind{'&': tokAnd, '|': tokOr, '=': tokEq}[r]
+			tokens = append(tokens, token{kind, string([]rune{r, r}), i})
+			i += 2
+		case r == '!':
+			if i+1 < len(rs) && rs[i+1] == '=' {
+				tokens = append(tokens, token{tokNe, "!=", i})
+				i += 2
+			} else {
+				tokens = append(tokens, token{tokNot, "!", i})
+				i++
+			}
+		case r == '"' || r == '\'':
+			j := i + 1
+			for ; j < len(rs) && rs[j] != r; j++ {
+				if rs[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(rs) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			text, err := unescape(rs[i+1 : j])
+			if err != nil {
+				return nil, fmt.Errorf("%v in string at offset %d", err, i)
+			}
+			tokens = append(tokens, token{tokString, text, i})
+			i = j + 1
+		case isIdentRune(r):
+			j := i
+			for j < len(rs) && isIdentRune(rs[j]) {
+				j++
+			}
+			text := string(rs[i:j])
+			kind := tokIdent
+			if unicode.IsDigit(r) {
+				kind = tokString
+			}
+			tokens = append(tokens, token{kind, text, i})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q at offset %d", r, i)
+		}
+	}
+	tokens = append(tokens, token{tokEOF, "", len(rs)})
+	return tokens, nil
+}
+
+func unescape(rs []rune) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(rs); i++ {
+		if rs[i] != '\\' {
+			b.WriteRune(rs[i])
+			continue
+		}
+		i++
+		switch rs[i] {
+		case '\\', '"', '\'':
+			b.WriteRune(rs[i])
+		case 'n':
+			b.WriteRune('\n')
+		case 't':
+			b.WriteRune('\t')
+		default:
+			return "", fmt.Errorf("invalid escape \\%c", rs[i])
+		}
+	}
+	return b.String(), nil
+}
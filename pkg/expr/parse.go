@@ -0,0 +1,172 @@
+package expr
+
+import (
+	"fmt"
+	"regexp"
+)
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, fmt.Errorf("expected %s, got %v at offset %d", what, t, t.pos)
+	}
+	return t, nil
+}
+
+func parse(tokens []token) (node, error) {
+	p := &parser{tokens: tokens}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %v at offset %d", t, t.pos)
+	}
+	return n, nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokAnd {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.peek().kind == tokNot {
+		p.next()
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{n}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	if p.peek().kind == tokLParen {
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokRParen, "')'"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (node, error) {
+	field, err := p.expect(tokIdent, "field name")
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	switch op.kind {
+	case tokEq, tokNe:
+		v, err := p.expect(tokString, "value")
+		if err != nil {
+			return nil, err
+		}
+		var n node = &cmpNode{field.text, opEqual, v.text, nil}
+		if op.kind == tokNe {
+			n = &notNode{n}
+		}
+		return n, nil
+	case tokIdent:
+		switch op.text {
+		case "in":
+			values, err := p.parseList()
+			if err != nil {
+				return nil, err
+			}
+			return &inNode{field.text, values}, nil
+		case "startsWith", "endsWith", "contains", "matches":
+			v, err := p.expect(tokString, "value")
+			if err != nil {
+				return nil, err
+			}
+			n := &cmpNode{field.text, op.text, v.text, nil}
+			if op.text == opMatches {
+				re, err := regexp.Compile(v.text)
+				if err != nil {
+					return nil, fmt.Errorf("invalid regexp at offset %d: %v", v.pos, err)
+				}
+				n.re = re
+			}
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("expected operator, got %v at offset %d", op, op.pos)
+}
+
+func (p *parser) parseList() (map[string]bool, error) {
+	if _, err := p.expect(tokLBracket, "'['"); err != nil {
+		return nil, err
+	}
+	values := make(map[string]bool)
+	if p.peek().kind == tokRBracket {
+		p.next()
+		return values, nil
+	}
+	for {
+		v, err := p.expect(tokString, "value")
+		if err != nil {
+			return nil, err
+		}
+		values[v.text] = true
+		t := p.next()
+		switch t.kind {
+		case tokComma:
+			continue
+		case tokRBracket:
+			return values, nil
+		}
+		return nil, fmt.Errorf("expected ',' or ']', got %v at offset %d", t, t.pos)
+	}
+}
@@ -0,0 +1,36 @@
+package secret
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var bcryptPrefixes = []string{"$2a$", "$2b$", "$2y$"}
+
+func IsHashed(s string) bool {
+	for _, p := range bcryptPrefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func Hash(s string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(s), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// Compare reports whether s matches stored, which is either a bcrypt hash
+// or a plaintext secret compared in constant time.
+func Compare(stored string, s string) bool {
+	if IsHashed(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(s)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(s)) == 1
+}
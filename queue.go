@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const queueExt = ".json"
+
+type queueItem struct {
+	Remote   string          `json:"remote"`
+	Data     json.RawMessage `json:"data"`
+	Attempts int             `json:"attempts"`
+
+	id   uint64
+	next time.Time
+	busy bool
+}
+
+// retryQueue is a bounded queue of undelivered events. When dir is set,
+// every item is also kept as a file so pending deliveries survive restarts.
+// Files are written by persist, so pushing an event never touches the disk.
+type retryQueue struct {
+	dir   string
+	size  int
+	lock  *sync.Mutex
+	items []*queueItem
+	seq   uint64
+	wake  chan struct{}
+
+	unsaved map[uint64]*queueItem
+	deleted []uint64
+	flush   chan struct{}
+}
+
+func newRetryQueue(dir string, size int) (*retryQueue, error) {
+	q := &retryQueue{
+		dir:     dir,
+		size:    size,
+		lock:    new(sync.Mutex),
+		wake:    make(chan struct{}, 1),
+		unsaved: make(map[uint64]*queueItem),
+		flush:   make(chan struct{}, 1),
+	}
+	if len(dir) == 0 {
+		return q, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, queueExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, queueExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		item := &queueItem{id: id}
+		if json.Unmarshal(data, item) != nil {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		q.items = append(q.items, item)
+		if id > q.seq {
+			q.seq = id
+		}
+	}
+	sort.Slice(q.items, func(a, b int) bool {
+		return q.items[a].id < q.items[b].id
+	})
+	return q, nil
+}
+
+func (q *retryQueue) path(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, queueExt))
+}
+
+func wake(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// save marks an item to be written by the next persist.
+func (q *retryQueue) save(item *queueItem) {
+	if len(q.dir) == 0 {
+		return
+	}
+	q.unsaved[item.id] = item
+	wake(q.flush)
+}
+
+func (q *retryQueue) remove(item *queueItem) {
+	for i, it := range q.items {
+		if it == item {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			break
+		}
+	}
+	if len(q.dir) > 0 {
+		delete(q.unsaved, item.id)
+		q.deleted = append(q.deleted, item.id)
+		wake(q.flush)
+	}
+}
+
+// persist writes the items changed and removes the files of the items
+// deleted since the last call.
+func (q *retryQueue) persist() error {
+	q.lock.Lock()
+	files := make(map[uint64][]byte, len(q.unsaved))
+	for id, item := range q.unsaved {
+		data, err := json.Marshal(item)
+		if err != nil {
+			q.lock.Unlock()
+			return err
+		}
+		files[id] = data
+	}
+	deleted := q.deleted
+	q.unsaved = make(map[uint64]*queueItem)
+	q.deleted = nil
+	q.lock.Unlock()
+
+	var err error
+	for id, data := range files {
+		path := q.path(id)
+		if werr := ioutil.WriteFile(path+".tmp", data, 0600); werr != nil {
+			err = werr
+			continue
+		}
+		if rerr := os.Rename(path+".tmp", path); rerr != nil {
+			err = rerr
+		}
+	}
+	for _, id := range deleted {
+		if rerr := os.Remove(q.path(id)); rerr != nil && !os.IsNotExist(rerr) {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// push adds an event to the queue and returns the number of older items
+// dropped to stay within the size limit.
+func (q *retryQueue) push(remote string, data []byte) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.seq++
+	item := &queueItem{Remote: remote, Data: data, id: q.seq}
+	q.save(item)
+	q.items = append(q.items, item)
+	dropped := 0
+	for i := 0; len(q.items) > q.size && i < len(q.items); {
+		if q.items[i].busy {
+			i++
+			continue
+		}
+		q.remove(q.items[i])
+		dropped++
+	}
+	wake(q.wake)
+	return dropped
+}
+
+// next reserves the oldest item that is due. If there is none, it returns
+// how long to wait before the next item becomes due.
+func (q *retryQueue) next() (*queueItem, time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	now := time.Now()
+	wait := time.Second
+	for _, item := range q.items {
+		if item.busy {
+			continue
+		}
+		if !item.next.After(now) {
+			item.busy = true
+			return item, 0
+		}
+		if d := item.next.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	return nil, wait
+}
+
+func (q *retryQueue) done(item *queueItem) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.remove(item)
+}
+
+// retry releases an item to be delivered again after delay.
+func (q *retryQueue) retry(item *queueItem, delay time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	item.Attempts++
+	item.next = time.Now().Add(delay)
+	item.busy = false
+	q.save(item)
+}
+
+// release returns an item without counting a delivery attempt.
+func (q *retryQueue) release(item *queueItem) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	item.busy = false
+}
+
+func (q *retryQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func queueIDs(q *retryQueue) []uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	ids := make([]uint64, 0, len(q.items))
+	for _, item := range q.items {
+		ids = append(ids, item.id)
+	}
+	return ids
+}
+
+func TestRetryQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := newRetryQueue(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	push := func(n int) int {
+		return q.push("r1", []byte(fmt.Sprintf(`{"n":%d}`, n)))
+	}
+	for n := 1; n <= 3; n++ {
+		if dropped := push(n); dropped != 0 {
+			t.Fatalf("push %d dropped %d items", n, dropped)
+		}
+	}
+	item, _ := q.next()
+	if item == nil || item.id != 1 {
+		t.Fatalf("got item %v, want item 1", item)
+	}
+	q.retry(item, 0)
+	// reserve the oldest item again, pushing must not drop it
+	if item, _ = q.next(); item == nil || item.id != 1 {
+		t.Fatalf("got item %v, want item 1", item)
+	}
+	for n := 4; n <= 5; n++ {
+		if dropped := push(n); dropped != 1 {
+			t.Fatalf("push %d dropped %d items, want 1", n, dropped)
+		}
+	}
+	if got := fmt.Sprint(queueIDs(q)); got != "[1 4 5]" {
+		t.Fatalf("got items %s, want [1 4 5]", got)
+	}
+	if err := q.persist(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 3 {
+		t.Errorf("got files %v, want 3 queue files", files)
+	}
+
+	q, err = newRetryQueue(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(queueIDs(q)); got != "[1 4 5]" {
+		t.Fatalf("got items %s after reopening, want [1 4 5]", got)
+	}
+	want := []struct {
+		data     string
+		attempts int
+	}{
+		{`{"n":1}`, 1},
+		{`{"n":4}`, 0},
+		{`{"n":5}`, 0},
+	}
+	for i, item := range q.items {
+		if item.Remote != "r1" || string(item.Data) != want[i].data || item.Attempts != want[i].attempts || item.busy {
+			t.Errorf("item %d is %+v, want data %s and %d attempts", item.id, item, want[i].data, want[i].attempts)
+		}
+	}
+	// new items continue the sequence
+	push(6)
+	if got := fmt.Sprint(queueIDs(q)); got != "[4 5 6]" {
+		t.Errorf("got items %s, want [4 5 6]", got)
+	}
+}
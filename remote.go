@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net/url"
 	"sync"
 	"time"
 
@@ -17,57 +19,106 @@ type Remote struct {
 	config   config.RemoteConf
 	bioStar2 *biostar2.API
 
-	recv chan []byte
-	send chan []byte
-	done chan struct{}
-	wait *sync.WaitGroup
-	lock *sync.Mutex
+	recv    chan []byte
+	send    chan []byte
+	pending chan *enrichJob
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wait    *sync.WaitGroup
+	lock    *sync.Mutex
+
+	enricher      *enricher
+	catalog       *biostar2.EventTypeCatalog
+	catalogSynced time.Time
+	filter        config.FilterConf
+
+	lastIndex   uint64
+	gaps        uint64
+	resets      uint64
+	reconnected bool
+
+	state        string
+	lastEvent    time.Time
+	lastError    string
+	lastErrorAt  time.Time
+	sessionStart time.Time
 
 	session      chan string
 	querySession chan bool
 	renewSession *time.Ticker
 }
 
+const (
+	stateConnecting     = "connecting"
+	stateAuthenticating = "authenticating"
+	stateStreaming      = "streaming"
+	stateBackingOff     = "backing off"
+)
+
 var (
-	remotes map[string]*Remote
+	remotes     map[string]*Remote
+	remotesLock = new(sync.RWMutex)
 )
 
 func startRemotes(conf *config.Config, hub *ws.Hub) {
+	remotesLock.Lock()
 	remotes = make(map[string]*Remote)
 	for name, rc := range conf.Remotes {
 		r := newRemote(name, rc, hub)
 		remotes[name] = r
 		go r.start()
 	}
+	remotesLock.Unlock()
 }
 
 func reloadRemotes(conf *config.Config, hub *ws.Hub) {
 	for name, r := range remotes {
 		nrc, ok := conf.Remotes[name]
 		if ok {
-			oc := r.config.BioStar2
-			nc := nrc.BioStar2
-			if oc.Url != nc.Url ||
-				oc.Username != nc.Username ||
-				oc.Password != nc.Password {
+			if r.config.BioStar2 != nrc.BioStar2 {
 				r.stop()
 				nr := newRemote(name, nrc, hub)
+				if nr.catalog == nil {
+					nr.catalog = r.catalog
+					nr.updateFilter(nrc.Filter)
+				}
+				nr.lastIndex = r.lastIndex
+				nr.reconnected = true
+				nr.gaps = r.gaps
+				nr.resets = r.resets
+				nr.lastEvent = r.lastEvent
+				remotesLock.Lock()
 				remotes[name] = nr
+				remotesLock.Unlock()
 				go nr.start()
+				continue
 			}
+			r.updateFilter(nrc.Filter)
 			r.lock.Lock()
-			r.config.Filter = nrc.Filter
+			r.config.Backfill = nrc.Backfill
+			r.config.Gap = nrc.Gap
+			if r.config.Enrich != nrc.Enrich {
+				r.enricher = nil
+				if nrc.Enrich.Enabled {
+					r.enricher = newEnricher(time.Duration(nrc.Enrich.TTL) * time.Second)
+				}
+				r.config.Enrich = nrc.Enrich
+			}
 			r.lock.Unlock()
 		} else {
 			r.stop()
+			remotesLock.Lock()
 			delete(remotes, name)
+			remotesLock.Unlock()
 		}
 	}
 	for name, rc := range conf.Remotes {
 		_, ok := remotes[name]
 		if !ok {
 			r := newRemote(name, rc, hub)
+			remotesLock.Lock()
 			remotes[name] = r
+			remotesLock.Unlock()
 			go r.start()
 		}
 	}
@@ -80,55 +131,200 @@ func stopRemotes(conf *config.Config, hub *ws.Hub) {
 }
 
 func newRemote(name string, rc config.RemoteConf, hub *ws.Hub) *Remote {
-	return &Remote{
+	ctx, cancel := context.WithCancel(context.Background())
+	var en *enricher
+	if rc.Enrich.Enabled {
+		en = newEnricher(time.Duration(rc.Enrich.TTL) * time.Second)
+	}
+	r := &Remote{
 		name:         name,
 		hub:          hub,
 		config:       rc,
 		bioStar2:     nil,
+		enricher:     en,
 		recv:         make(chan []byte),
 		send:         make(chan []byte),
-		done:         make(chan struct{}),
+		pending:      make(chan *enrichJob, enrichQueueSize),
+		ctx:          ctx,
+		cancel:       cancel,
 		wait:         new(sync.WaitGroup),
 		lock:         new(sync.Mutex),
+		state:        stateConnecting,
 		session:      make(chan string),
 		querySession: make(chan bool),
 		renewSession: time.NewTicker(time.Duration(rc.Retry.Session) * time.Second),
 	}
+	r.catalog = loadCatalog(name)
+	r.updateFilter(rc.Filter)
+	return r
+}
+
+func newBioStar2API(bs2c config.BioStar2Conf) (*biostar2.API, error) {
+	tlsConfig, err := newTLSConfig(bs2c.TLS)
+	if err != nil {
+		return nil, err
+	}
+	opts := []biostar2.Option{
+		biostar2.WithTLSConfig(tlsConfig),
+		biostar2.WithTimeout(time.Duration(bs2c.Timeout) * time.Second),
+	}
+	if len(bs2c.UserAgent) > 0 {
+		opts = append(opts, biostar2.WithUserAgent(bs2c.UserAgent))
+	}
+	if len(bs2c.Proxy) > 0 {
+		proxy, err := url.Parse(bs2c.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %v", err)
+		}
+		opts = append(opts, biostar2.WithProxy(proxy))
+	}
+	return biostar2.NewAPI(bs2c.Url, bs2c.Username, bs2c.Password, opts...), nil
 }
 
 func (r *Remote) log(f string, v ...interface{}) {
 	log.Printf("[remote."+r.name+"] "+f, v...)
 }
 
+func (r *Remote) setState(state string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.state = state
+}
+
+func (r *Remote) setError(err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.lastError = err.Error()
+	r.lastErrorAt = time.Now()
+}
+
+func (r *Remote) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
 func (r *Remote) start() {
-	r.wait.Add(2)
+	r.wait.Add(1)
 	defer r.wait.Done()
+	for {
+		bs2api, err := newBioStar2API(r.config.BioStar2)
+		if err == nil {
+			r.bioStar2 = bs2api
+			break
+		}
+		retry := time.Duration(r.config.Retry.WebSocket) * time.Second
+		r.log("configuration error: %v, retry in %v", err, retry)
+		r.setError(err)
+		r.setState(stateBackingOff)
+		if !r.sleep(retry) {
+			r.log("stopping main routine")
+			return
+		}
+	}
+	defer r.bioStar2.Close()
+	r.wait.Add(2)
 	go r.loop()
+	go r.deliver()
 	for {
-		bs2c := r.config.BioStar2
-		r.bioStar2 = biostar2.NewAPI(bs2c.Url, bs2c.Username, bs2c.Password)
 		r.log("connecting to websocket")
-		r.querySession <- true
-		r.bioStar2.WebSocket(r.recv, r.send, r.done)
+		r.setState(stateConnecting)
 		select {
-		case <-r.done:
+		case r.querySession <- true:
+		case <-r.ctx.Done():
 			r.log("stopping main routine")
 			return
-		default:
 		}
+		err := r.bioStar2.WebSocket(r.ctx, r.recv, r.send)
+		if r.ctx.Err() != nil {
+			r.log("stopping main routine")
+			return
+		}
+		if err != nil {
+			r.log("websocket error: %v", err)
+			r.setError(err)
+		}
+		r.lock.Lock()
+		r.reconnected = true
+		r.lock.Unlock()
+		r.setState(stateBackingOff)
 		retry := time.Duration(r.config.Retry.WebSocket) * time.Second
 		r.log("retry connecting to websocket in %v", retry)
-		time.Sleep(retry)
+		if !r.sleep(retry) {
+			r.log("stopping main routine")
+			return
+		}
+		websocketReconnects.Inc(r.name)
 	}
 }
 
 func (r *Remote) stop() {
 	r.log("stopping")
-	close(r.done)
+	r.cancel()
 	r.wait.Wait()
 	r.log("stopped")
 }
 
+func (r *Remote) authenticate() {
+	reauth := false
+	for {
+		bs2api := r.bioStar2
+		r.log("authentication")
+		r.setState(stateAuthenticating)
+		err := bs2api.Auth(r.ctx)
+		if err != nil && r.ctx.Err() == nil {
+			authFailures.Inc(r.name)
+		}
+		if err == nil {
+			r.lock.Lock()
+			r.sessionStart = time.Now()
+			r.lock.Unlock()
+			select {
+			case r.session <- bs2api.SessionID():
+			case <-r.ctx.Done():
+				return
+			}
+			r.syncEventTypes(bs2api)
+			r.backfill(bs2api)
+			err = bs2api.StartEvents(r.ctx)
+			if err == nil {
+				r.lock.Lock()
+				// the websocket may have dropped while authenticating
+				if r.state == stateAuthenticating {
+					r.state = stateStreaming
+				}
+				r.lock.Unlock()
+				return
+			}
+		}
+		if r.ctx.Err() != nil {
+			return
+		}
+		r.setError(err)
+		r.setState(stateBackingOff)
+		retry := time.Duration(r.config.Retry.Http) * time.Second
+		switch err {
+		case biostar2.ErrSessionExpired:
+			if !reauth {
+				reauth = true
+				r.log("session expired, authenticating again")
+				continue
+			}
+			r.log("session expired, retry authentication in %v", retry)
+		case biostar2.ErrUnauthorized:
+			r.log("invalid credentials, retry authentication in %v", retry)
+		default:
+			r.log("authentication failed: %v, retry in %v", err, retry)
+		}
+		if !r.sleep(retry) {
+			return
+		}
+	}
+}
+
 func (r *Remote) loop() {
 	defer r.wait.Done()
 	for {
@@ -138,20 +334,7 @@ func (r *Remote) loop() {
 			go func() { r.querySession <- true }()
 		case <-r.querySession:
 			r.log("query session")
-			go func() {
-				for {
-					bs2api := r.bioStar2
-					r.log("authentication")
-					if bs2api.Auth() {
-						r.session <- bs2api.SessionID()
-						bs2api.StartEvents()
-						break
-					}
-					retry := time.Duration(r.config.Retry.Http) * time.Second
-					r.log("retry authentication in %v", retry)
-					time.Sleep(retry)
-				}
-			}()
+			go r.authenticate()
 		case sid := <-r.session:
 			r.log("update session")
 			msg := []byte(fmt.Sprintf("bs-session-id=%s", sid))
@@ -163,6 +346,8 @@ func (r *Remote) loop() {
 				if resp.Code != "0" {
 					retry := time.Duration(r.config.Retry.WebSocket) * time.Second
 					r.log("invalid auth. rety in %v", retry)
+					r.setError(fmt.Errorf("websocket auth response code: %s, msg: %s", resp.Code, resp.Message))
+					r.setState(stateBackingOff)
 					go func() {
 						time.Sleep(retry)
 						r.querySession <- true
@@ -172,16 +357,27 @@ func (r *Remote) loop() {
 			}
 			e, ok := biostar2.ParseEvent(msg)
 			if ok {
+				r.updateIndex(e)
 				r.lock.Lock()
-				filter := r.config.Filter
+				r.lastEvent = time.Now()
+				filter := r.filter
 				ok := filterEvent(&filter, e)
 				r.lock.Unlock()
-				if ok {
-					r.log("filtered event: %v", e)
-					r.hub.Broadcast(msg)
+				code := e.EventType.Code
+				eventsReceived.Inc(r.name, code)
+				if !ok {
+					eventsDropped.Inc(r.name, code)
+					continue
+				}
+				eventsFiltered.Inc(r.name, code)
+				select {
+				case r.pending <- r.enrich(e, msg):
+				case <-r.ctx.Done():
+					r.log("stopping loop routine")
+					return
 				}
 			}
-		case <-r.done:
+		case <-r.ctx.Done():
 			r.log("stopping loop routine")
 			return
 		}
@@ -2,22 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"path/filepath"
 	"sync"
 	"time"
 
 	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/internal/pkg/metrics"
 	"bs2-evt-filter/internal/pkg/ws"
 )
 
 type Server struct {
-	conf *config.Config
-	hub  *ws.Hub
-	srv  *http.Server
-	done chan struct{}
-	wait *sync.WaitGroup
+	conf   *config.Config
+	hub    *ws.Hub
+	srv    *http.Server
+	active config.ServerConf
+	certs  *certWatcher
+	lock   *sync.Mutex
+	done   chan struct{}
+	wait   *sync.WaitGroup
 }
 
 func newServer(conf *config.Config, hub *ws.Hub) *Server {
@@ -25,10 +33,51 @@ func newServer(conf *config.Config, hub *ws.Hub) *Server {
 		conf: conf,
 		hub:  hub,
 		srv:  nil,
+		lock: new(sync.Mutex),
 		done: make(chan struct{}),
 		wait: new(sync.WaitGroup)}
 }
 
+func serverPath(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return appPath(p)
+}
+
+func (s *Server) tlsConfig(sc config.ServerConf) (*tls.Config, error) {
+	certFile, keyFile := serverPath(sc.Cert), serverPath(sc.Key)
+	if s.certs == nil || s.certs.certFile != filepath.Clean(certFile) || s.certs.keyFile != filepath.Clean(keyFile) {
+		certs, err := newCertWatcher(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if s.certs != nil {
+			s.certs.close()
+		}
+		s.certs = certs
+	}
+	c := &tls.Config{GetCertificate: s.certs.getCertificate}
+	if len(sc.ClientCA) == 0 {
+		return c, nil
+	}
+	path := serverPath(sc.ClientCA)
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	c.ClientCAs = pool
+	c.ClientAuth = tls.VerifyClientCertIfGiven
+	if sc.RequireCert {
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
 func (s *Server) log(f string, v ...interface{}) {
 	log.Printf("[srv] "+f, v...)
 }
@@ -41,28 +90,50 @@ func (s *Server) start() {
 	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		s.hub.Client(w, r)
 	})
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.HandleFunc("/status", statusHandler(s.conf, s.hub))
+	mux.Handle("/metrics", metrics.Handler())
 	s.srv = new(http.Server)
 	s.wait.Add(1)
 	go func() {
 		defer s.wait.Done()
 		for {
-			addr := fmt.Sprintf(":%d", s.conf.Server.Port)
+			active := s.conf.Server
+			s.lock.Lock()
+			s.active = active
+			s.lock.Unlock()
+			addr := fmt.Sprintf(":%d", active.Port)
 			s.log("starting on %s", addr)
-			*s.srv = http.Server{Addr: addr, Handler: mux}
-			err := s.srv.ListenAndServeTLS(appPath("server.crt"), appPath("server.key"))
+			tlsConfig, err := s.tlsConfig(active)
+			if err == nil {
+				s.lock.Lock()
+				*s.srv = http.Server{Addr: addr, Handler: mux, TLSConfig: tlsConfig}
+				s.lock.Unlock()
+				err = s.srv.ListenAndServeTLS("", "")
+			}
 			if err != http.ErrServerClosed {
 				s.log("serve error: %v", err)
 			}
 			retry := 10 * time.Second
 			select {
 			case <-s.done:
+				if s.certs != nil {
+					s.certs.close()
+				}
 				return
 			default:
+				if err == http.ErrServerClosed {
+					continue
+				}
 				s.log("retry in %v", retry)
 			}
 			timeout := time.After(retry)
 			select {
 			case <-s.done:
+				if s.certs != nil {
+					s.certs.close()
+				}
 				return
 			case <-timeout:
 				break
@@ -72,16 +143,24 @@ func (s *Server) start() {
 }
 
 func (s *Server) shutdown() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	if err := s.srv.Shutdown(context.Background()); err != nil {
 		s.log("shutdown error: %v", err)
 	}
-	s.wait.Wait()
 	s.log("shutdown")
 
 }
 func (s *Server) reload() {
-	addr := fmt.Sprintf(":%d", s.conf.Server.Port)
-	if s.srv.Addr != addr {
+	sc := s.conf.Server
+	s.lock.Lock()
+	active := s.active
+	s.lock.Unlock()
+	if active.Port != sc.Port ||
+		active.Cert != sc.Cert ||
+		active.Key != sc.Key ||
+		active.ClientCA != sc.ClientCA ||
+		active.RequireCert != sc.RequireCert {
 		s.log("restarting")
 		s.shutdown()
 	}
@@ -92,5 +171,6 @@ func (s *Server) stop() {
 	s.log("stopping")
 	close(s.done)
 	s.shutdown()
+	s.wait.Wait()
 	s.log("stopped")
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/internal/pkg/ws"
+)
+
+const (
+	siemVendor  = "Suprema"
+	siemProduct = "BioStar 2"
+	siemVersion = "2"
+
+	leefTimeFormat = "yyyy-MM-dd'T'HH:mm:ss.SSSZ"
+	leefTimeLayout = "2006-01-02T15:04:05.000-0700"
+)
+
+var (
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, "|", `\|`, "\n", " ", "\r", " ")
+	cefValueEscaper  = strings.NewReplacer(`\`, `\\`, "=", `\=`, "\n", `\n`, "\r", `\r`)
+	leefValueEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+)
+
+// siemField pairs a CEF or LEEF extension key with an event field.
+type siemField struct {
+	key   string
+	field string
+}
+
+var cefFields = []siemField{
+	{"externalId", "index"},
+	{"deviceExternalId", "device.id"},
+	{"cs1", "device.name"},
+	{"suid", "user.id"},
+	{"suser", "user.name"},
+	{"cs2", "user_group.name"},
+	{"cs3", "door.id"},
+	{"cs4", "door.name"},
+	{"cs5", "remote"},
+}
+
+var cefLabels = map[string]string{
+	"cs1": "deviceName",
+	"cs2": "userGroup",
+	"cs3": "doorId",
+	"cs4": "doorName",
+	"cs5": "remote",
+}
+
+var leefFields = []siemField{
+	{"usrName", "user.name"},
+	{"userId", "user.id"},
+	{"userGroup", "user_group.name"},
+	{"deviceId", "device.id"},
+	{"deviceName", "device.name"},
+	{"doorId", "door.id"},
+	{"doorName", "door.name"},
+	{"remote", "remote"},
+	{"index", "index"},
+}
+
+func firstField(m *ws.Message, name string) string {
+	values := m.Field(name)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// eventSeverity maps an event to a CEF severity. An exact code wins over
+// name patterns; if several patterns match, the highest severity is used.
+func eventSeverity(sc config.SeverityConf, code, name string) int {
+	if sev, ok := sc.Codes[code]; ok {
+		return sev
+	}
+	sev, found := 0, false
+	if len(name) > 0 {
+		name = strings.ToUpper(name)
+		for pattern, v := range sc.Names {
+			if ok, _ := path.Match(pattern, name); ok && (!found || v > sev) {
+				sev, found = v, true
+			}
+		}
+	}
+	if !found {
+		return sc.Default
+	}
+	return sev
+}
+
+// syslogSeverity maps a CEF severity to the RFC 5424 severity.
+func syslogSeverity(sev int) int {
+	switch {
+	case sev >= 9:
+		return 2 // critical
+	case sev >= 7:
+		return 3 // error
+	case sev >= 4:
+		return 4 // warning
+	}
+	return 6 // informational
+}
+
+func formatCEF(m *ws.Message, name string, sev int) string {
+	code := m.Event.EventType.Code
+	if len(name) == 0 {
+		name = code
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|",
+		cefHeaderEscaper.Replace(siemVendor),
+		cefHeaderEscaper.Replace(siemProduct),
+		cefHeaderEscaper.Replace(siemVersion),
+		cefHeaderEscaper.Replace(code),
+		cefHeaderEscaper.Replace(name),
+		sev)
+	var ext []string
+	if t, err := m.Event.Time(); err == nil {
+		ext = append(ext, "rt="+strconv.FormatInt(t.UnixNano()/1e6, 10))
+	}
+	for _, f := range cefFields {
+		v := firstField(m, f.field)
+		if len(v) == 0 {
+			continue
+		}
+		if label, ok := cefLabels[f.key]; ok {
+			ext = append(ext, f.key+"Label="+label)
+		}
+		ext = append(ext, f.key+"="+cefValueEscaper.Replace(v))
+	}
+	b.WriteString(strings.Join(ext, " "))
+	return b.String()
+}
+
+func formatLEEF(m *ws.Message, name string, sev int) string {
+	code := m.Event.EventType.Code
+	if len(name) == 0 {
+		name = code
+	}
+	if sev < 1 {
+		sev = 1
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:1.0|%s|%s|%s|%s|",
+		cefHeaderEscaper.Replace(siemVendor),
+		cefHeaderEscaper.Replace(siemProduct),
+		cefHeaderEscaper.Replace(siemVersion),
+		cefHeaderEscaper.Replace(code))
+	attrs := []string{
+		"cat=" + leefValueEscaper.Replace(name),
+		"sev=" + strconv.Itoa(sev),
+	}
+	if t, err := m.Event.Time(); err == nil {
+		attrs = append(attrs, "devTime="+t.Format(leefTimeLayout), "devTimeFormat="+leefTimeFormat)
+	}
+	for _, f := range leefFields {
+		if v := firstField(m, f.field); len(v) > 0 {
+			attrs = append(attrs, f.key+"="+leefValueEscaper.Replace(v))
+		}
+	}
+	b.WriteString(strings.Join(attrs, "\t"))
+	return b.String()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+
+	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/internal/pkg/ws"
+	"bs2-evt-filter/pkg/biostar2"
+)
+
+func siemMessage(deviceName string) *ws.Message {
+	return &ws.Message{
+		Remote: "local",
+		Event: &biostar2.Event{
+			Index:     "1",
+			EventType: biostar2.EventType{Code: "4865"},
+			Device:    biostar2.Device{ID: "541", Name: deviceName},
+		},
+	}
+}
+
+func TestCEFHeaderEscaping(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"VERIFY_SUCCESS", "VERIFY_SUCCESS"},
+		{"", "4865"},
+		{"a|b", `a\|b`},
+		{`a\b`, `a\\b`},
+		{`a\|b`, `a\\\|b`},
+		{"a\nb", "a b"},
+		{"a\r\nb", "a  b"},
+		{"a=b", "a=b"},
+	}
+	msg := siemMessage("")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := "CEF:0|Suprema|BioStar 2|2|4865|" + tt.want + "|5|" +
+				"externalId=1 deviceExternalId=541 cs5Label=remote cs5=local"
+			if got := formatCEF(msg, tt.name, 5); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCEFExtensionEscaping(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"front door", "front door"},
+		{"a=b", `a\=b`},
+		{`a\b`, `a\\b`},
+		{`a\=b`, `a\\\=b`},
+		{"a\nb", `a\nb`},
+		{"a\rb", `a\rb`},
+		{"a|b", "a|b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			want := "CEF:0|Suprema|BioStar 2|2|4865|VERIFY_SUCCESS|5|" +
+				"externalId=1 deviceExternalId=541 cs1Label=deviceName cs1=" + tt.want +
+				" cs5Label=remote cs5=local"
+			if got := formatCEF(siemMessage(tt.value), "VERIFY_SUCCESS", 5); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLEEFEscaping(t *testing.T) {
+	tests := []struct {
+		name       string
+		deviceName string
+		sev        int
+		want       string
+	}{
+		{"VERIFY_SUCCESS", "front door", 5, "cat=VERIFY_SUCCESS\tsev=5\tdeviceId=541\tdeviceName=front door"},
+		{"", "", 5, "cat=4865\tsev=5\tdeviceId=541"},
+		{"a\tb", "c\td", 5, "cat=a b\tsev=5\tdeviceId=541\tdeviceName=c d"},
+		{"a\nb", "c\r\nd", 5, "cat=a b\tsev=5\tdeviceId=541\tdeviceName=c  d"},
+		{"a|b=c", `c\d`, 5, "cat=a|b=c\tsev=5\tdeviceId=541\tdeviceName=c\\d"},
+		{"VERIFY_SUCCESS", "", 0, "cat=VERIFY_SUCCESS\tsev=1\tdeviceId=541"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := "LEEF:1.0|Suprema|BioStar 2|2|4865|" + tt.want + "\tremote=local\tindex=1"
+			if got := formatLEEF(siemMessage(tt.deviceName), tt.name, tt.sev); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestEventSeverity(t *testing.T) {
+	sc := config.SeverityConf{
+		Default: 3,
+		Codes:   map[string]int{"4865": 8, "4096": 0},
+		Names: map[string]int{
+			"IDENTIFY_*":      5,
+			"IDENTIFY_FAIL_*": 7,
+			"*_FAIL*":         6,
+			"VERIFY_SUCCESS":  2,
+		},
+	}
+	tests := []struct {
+		code string
+		name string
+		want int
+	}{
+		{"4865", "IDENTIFY_FAIL_CARD", 8},
+		{"4096", "IDENTIFY_FAIL_CARD", 0},
+		{"1", "IDENTIFY_FAIL_CARD", 7},
+		{"1", "identify_success_card", 5},
+		{"1", "VERIFY_FAIL_PIN", 6},
+		{"1", "VERIFY_SUCCESS", 2},
+		{"1", "DOOR_OPEN", 3},
+		{"1", "", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.code+" "+tt.name, func(t *testing.T) {
+			if got := eventSeverity(sc, tt.code, tt.name); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
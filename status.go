@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/internal/pkg/ws"
+)
+
+type remoteStatus struct {
+	State       string     `json:"state"`
+	LastEvent   *time.Time `json:"last_event,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	SessionAge  int64      `json:"session_age,omitempty"`
+	LastIndex   uint64     `json:"last_index"`
+	Gaps        uint64     `json:"gaps"`
+	Resets      uint64     `json:"resets"`
+}
+
+type appStatus struct {
+	ConfigReload  time.Time                `json:"config_reload"`
+	ConfigError   string                   `json:"config_error,omitempty"`
+	ConfigErrorAt *time.Time               `json:"config_error_at,omitempty"`
+	Clients       ws.Stats                 `json:"clients"`
+	Remotes       map[string]*remoteStatus `json:"remotes"`
+}
+
+func optTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (r *Remote) status() *remoteStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rs := &remoteStatus{
+		State:       r.state,
+		LastEvent:   optTime(r.lastEvent),
+		LastError:   r.lastError,
+		LastErrorAt: optTime(r.lastErrorAt),
+		LastIndex:   r.lastIndex,
+		Gaps:        r.gaps,
+		Resets:      r.resets,
+	}
+	if !r.sessionStart.IsZero() {
+		rs.SessionAge = int64(time.Since(r.sessionStart) / time.Second)
+	}
+	return rs
+}
+
+func remoteStatuses() map[string]*remoteStatus {
+	remotesLock.RLock()
+	defer remotesLock.RUnlock()
+	statuses := make(map[string]*remoteStatus)
+	for name, r := range remotes {
+		statuses[name] = r.status()
+	}
+	return statuses
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "ok\n")
+}
+
+// readyzHandler reports ready once every configured remote is streaming.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	var pending []string
+	for name, rs := range remoteStatuses() {
+		if rs.State != stateStreaming {
+			pending = append(pending, name)
+		}
+	}
+	if len(pending) > 0 {
+		sort.Strings(pending)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, name := range pending {
+			fmt.Fprintf(w, "remote %s not ready\n", name)
+		}
+		return
+	}
+	fmt.Fprintf(w, "ok\n")
+}
+
+func statusHandler(conf *config.Config, hub *ws.Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		configError, configErrorAt := conf.LastError()
+		st := &appStatus{
+			ConfigReload:  conf.LastReload(),
+			ConfigError:   configError,
+			ConfigErrorAt: optTime(configErrorAt),
+			Clients:       hub.Stats(),
+			Remotes:       remoteStatuses(),
+		}
+		data, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/internal/pkg/metrics"
+	"bs2-evt-filter/internal/pkg/ws"
+)
+
+const syslogTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+
+type Syslog struct {
+	name      string
+	config    config.SyslogConf
+	tlsConfig *tls.Config
+	hostname  string
+	conn      net.Conn
+
+	queue   chan []byte
+	pending []byte
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wait   *sync.WaitGroup
+}
+
+var (
+	syslogs     map[string]*Syslog
+	syslogsLock = new(sync.RWMutex)
+)
+
+func startSyslog(conf *config.Config) {
+	syslogsLock.Lock()
+	defer syslogsLock.Unlock()
+	syslogs = make(map[string]*Syslog)
+	for name, sc := range conf.Syslog {
+		if s := newSyslog(name, sc); s != nil {
+			syslogs[name] = s
+			s.start()
+		}
+	}
+}
+
+func reloadSyslog(conf *config.Config) {
+	syslogsLock.Lock()
+	defer syslogsLock.Unlock()
+	for name, s := range syslogs {
+		nsc, ok := conf.Syslog[name]
+		if ok && sameSyslogConf(s.config, nsc) {
+			continue
+		}
+		s.stop()
+		delete(syslogs, name)
+	}
+	for name, sc := range conf.Syslog {
+		if _, ok := syslogs[name]; ok {
+			continue
+		}
+		if s := newSyslog(name, sc); s != nil {
+			syslogs[name] = s
+			s.start()
+		}
+	}
+}
+
+func stopSyslog() {
+	syslogsLock.Lock()
+	defer syslogsLock.Unlock()
+	for _, s := range syslogs {
+		s.stop()
+	}
+}
+
+func publishSyslog(m *ws.Message) {
+	syslogsLock.RLock()
+	defer syslogsLock.RUnlock()
+	for _, s := range syslogs {
+		s.publish(m)
+	}
+}
+
+func syslogQueueDepths() []metrics.Sample {
+	syslogsLock.RLock()
+	defer syslogsLock.RUnlock()
+	var samples []metrics.Sample
+	for name, s := range syslogs {
+		samples = append(samples, metrics.Sample{Labels: []string{name}, Value: float64(len(s.queue))})
+	}
+	return samples
+}
+
+func sameSyslogConf(a, b config.SyslogConf) bool {
+	if exprString(a.Filter) != exprString(b.Filter) {
+		return false
+	}
+	a.Filter, b.Filter = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+func newSyslog(name string, sc config.SyslogConf) *Syslog {
+	s := &Syslog{
+		name:   name,
+		config: sc,
+		queue:  make(chan []byte, sc.QueueSize),
+		wait:   new(sync.WaitGroup),
+	}
+	if sc.Network == "tls" {
+		tlsConfig, err := newTLSConfig(sc.TLS)
+		if err != nil {
+			s.log("tls configuration error: %v", err)
+			return nil
+		}
+		s.tlsConfig = tlsConfig
+	}
+	s.hostname = sc.Hostname
+	if len(s.hostname) == 0 {
+		s.hostname, _ = os.Hostname()
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+func (s *Syslog) log(f string, v ...interface{}) {
+	log.Printf("[syslog."+s.name+"] "+f, v...)
+}
+
+func (s *Syslog) sleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+func (s *Syslog) start() {
+	s.wait.Add(1)
+	go s.run()
+}
+
+func (s *Syslog) stop() {
+	s.log("stopping")
+	s.cancel()
+	s.wait.Wait()
+	// events still queued are lost with this instance
+	dropped := len(s.queue)
+	if s.pending != nil {
+		dropped++
+	}
+	if dropped > 0 {
+		s.log("dropping %d queued events", dropped)
+		syslogMessages.Add(float64(dropped), s.name, "dropped")
+	}
+	s.log("stopped")
+}
+
+func (s *Syslog) publish(m *ws.Message) {
+	if m.Event == nil {
+		return
+	}
+	if len(s.config.Remotes) > 0 && !s.config.Remotes[m.Remote] {
+		return
+	}
+	if s.config.Filter != nil && !s.config.Filter.Match(m) {
+		return
+	}
+	select {
+	case s.queue <- s.format(m):
+	default:
+		s.log("queue full, dropping event")
+		syslogMessages.Inc(s.name, "dropped")
+	}
+}
+
+// header sanitizes an RFC 5424 header field: printable ASCII without
+// spaces, "-" when empty.
+func header(v string, max int) string {
+	v = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, v)
+	if len(v) == 0 {
+		return "-"
+	}
+	if len(v) > max {
+		v = v[:max]
+	}
+	return v
+}
+
+func (s *Syslog) format(m *ws.Message) []byte {
+	code := m.Event.EventType.Code
+	name := m.Event.EventType.Name
+	if len(name) == 0 {
+		name = eventTypeName(m.Remote, code)
+	}
+	sev := eventSeverity(s.config.Severity, code, name)
+	var msg string
+	switch s.config.Format {
+	case "leef":
+		msg = formatLEEF(m, name, sev)
+	default:
+		msg = formatCEF(m, name, sev)
+	}
+	t, err := m.Event.Time()
+	if err != nil {
+		t = time.Now()
+	}
+	line := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		s.config.Facility*8+syslogSeverity(sev),
+		t.Format(syslogTimeLayout),
+		header(s.hostname, 255),
+		header(s.config.AppName, 48),
+		os.Getpid(),
+		header(code, 32),
+		msg)
+	return []byte(line)
+}
+
+func (s *Syslog) run() {
+	defer s.wait.Done()
+	retry := time.Duration(s.config.Retry) * time.Second
+	for {
+		s.log("connecting to %s://%s", s.config.Network, s.config.Address)
+		err := s.connect()
+		if err == nil {
+			s.log("connected")
+			err = s.loop()
+			s.conn.Close()
+		}
+		if s.ctx.Err() != nil {
+			s.log("stopping main routine")
+			return
+		}
+		s.log("connection error: %v, retry in %v", err, retry)
+		if !s.sleep(retry) {
+			s.log("stopping main routine")
+			return
+		}
+		syslogReconnects.Inc(s.name)
+	}
+}
+
+func (s *Syslog) connect() error {
+	dialer := &net.Dialer{Timeout: time.Duration(s.config.Timeout) * time.Second}
+	var err error
+	switch s.config.Network {
+	case "tls":
+		td := &tls.Dialer{NetDialer: dialer, Config: s.tlsConfig}
+		s.conn, err = td.DialContext(s.ctx, "tcp", s.config.Address)
+	default:
+		s.conn, err = dialer.DialContext(s.ctx, s.config.Network, s.config.Address)
+	}
+	return err
+}
+
+// loop writes queued messages until a write fails. A message that failed
+// is kept and written first after reconnecting.
+func (s *Syslog) loop() error {
+	done := make(chan struct{})
+	defer close(done)
+	go func(conn net.Conn) {
+		select {
+		case <-s.ctx.Done():
+			// unblock a write to an unresponsive receiver
+			conn.Close()
+		case <-done:
+		}
+	}(s.conn)
+	for {
+		msg := s.pending
+		if msg == nil {
+			select {
+			case msg = <-s.queue:
+			case <-s.ctx.Done():
+				return nil
+			}
+		}
+		s.pending = msg
+		if err := s.write(msg); err != nil {
+			if s.ctx.Err() != nil {
+				return nil
+			}
+			syslogMessages.Inc(s.name, "failed")
+			return err
+		}
+		s.pending = nil
+		syslogMessages.Inc(s.name, "sent")
+	}
+}
+
+func (s *Syslog) write(msg []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(time.Duration(s.config.Timeout) * time.Second))
+	if s.config.Network == "udp" {
+		_, err := s.conn.Write(msg)
+		return err
+	}
+	var frame []byte
+	switch s.config.Framing {
+	case "newline":
+		frame = append(msg, '\n')
+	default:
+		// octet counting, RFC 6587 and RFC 5425
+		frame = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	}
+	_, err := s.conn.Write(frame)
+	return err
+}
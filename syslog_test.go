@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/internal/pkg/ws"
+	"bs2-evt-filter/pkg/biostar2"
+)
+
+func TestSyslogTimestamp(t *testing.T) {
+	s := newSyslog("test", config.SyslogConf{
+		Network:  "udp",
+		Address:  "127.0.0.1:514",
+		Hostname: "host",
+		AppName:  "bs2",
+		Facility: 1,
+	})
+	if s == nil {
+		t.Fatal("newSyslog failed")
+	}
+	tests := []struct {
+		datetime string
+		want     string
+	}{
+		{"2026-01-02T03:04:05.678Z", "2026-01-02T03:04:05.678000Z"},
+		{"2026-01-02T03:04:05+02:00", "2026-01-02T03:04:05.000000+02:00"},
+		{"", ""},
+		{"not a time", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.datetime, func(t *testing.T) {
+			msg := &ws.Message{
+				Remote: "local",
+				Event: &biostar2.Event{
+					Datetime:  tt.datetime,
+					EventType: biostar2.EventType{Code: "4865", Name: "VERIFY_SUCCESS"},
+					Device:    biostar2.Device{ID: "541"},
+				},
+			}
+			fields := strings.SplitN(string(s.format(msg)), " ", 3)
+			if len(fields) < 3 {
+				t.Fatalf("malformed message: %q", fields)
+			}
+			if len(tt.want) > 0 {
+				if fields[1] != tt.want {
+					t.Errorf("got timestamp %s, want %s", fields[1], tt.want)
+				}
+				return
+			}
+			ts, err := time.Parse(syslogTimeLayout, fields[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := time.Since(ts); d < 0 || d > time.Minute {
+				t.Errorf("timestamp %s is not the current time", fields[1])
+			}
+		})
+	}
+}
+
+// TestSyslogStopUnresponsive checks that stopping does not wait for the
+// timeout of a receiver that never completes the TLS handshake.
+func TestSyslogStopUnresponsive(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	const name = "unresponsive"
+	s := newSyslog(name, config.SyslogConf{
+		Network:   "tls",
+		Address:   ln.Addr().String(),
+		Timeout:   30,
+		Retry:     1,
+		QueueSize: 10,
+	})
+	if s == nil {
+		t.Fatal("newSyslog failed")
+	}
+	dropped := syslogMessages.Value(name, "dropped")
+	s.start()
+	conn := <-accepted
+	defer conn.Close()
+	s.publish(&ws.Message{
+		Remote: "local",
+		Event: &biostar2.Event{
+			EventType: biostar2.EventType{Code: "4865", Name: "VERIFY_SUCCESS"},
+			Device:    biostar2.Device{ID: "541"},
+		},
+	})
+	start := time.Now()
+	s.stop()
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("stop took %v", d)
+	}
+	if n := syslogMessages.Value(name, "dropped") - dropped; n != 1 {
+		t.Errorf("got %v dropped events, want 1", n)
+	}
+}
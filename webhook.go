@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"bs2-evt-filter/internal/pkg/config"
+	"bs2-evt-filter/internal/pkg/metrics"
+	"bs2-evt-filter/internal/pkg/ws"
+)
+
+const webhookTimestampHeader = "X-BS2-Timestamp"
+
+type Webhook struct {
+	name   string
+	config config.WebhookConf
+	client *http.Client
+	queue  *retryQueue
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wait   *sync.WaitGroup
+}
+
+var (
+	webhooks     map[string]*Webhook
+	webhooksLock = new(sync.RWMutex)
+)
+
+func startWebhooks(conf *config.Config) {
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	webhooks = make(map[string]*Webhook)
+	for name, wc := range conf.Webhooks {
+		if w := newWebhook(name, wc); w != nil {
+			webhooks[name] = w
+			w.start()
+		}
+	}
+}
+
+func reloadWebhooks(conf *config.Config) {
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	for name, w := range webhooks {
+		nwc, ok := conf.Webhooks[name]
+		if ok && sameWebhookConf(w.config, nwc) {
+			continue
+		}
+		w.stop()
+		delete(webhooks, name)
+	}
+	for name, wc := range conf.Webhooks {
+		if _, ok := webhooks[name]; ok {
+			continue
+		}
+		if w := newWebhook(name, wc); w != nil {
+			webhooks[name] = w
+			w.start()
+		}
+	}
+}
+
+func stopWebhooks() {
+	webhooksLock.Lock()
+	defer webhooksLock.Unlock()
+	for _, w := range webhooks {
+		w.stop()
+	}
+}
+
+func publishWebhooks(m *ws.Message) {
+	webhooksLock.RLock()
+	defer webhooksLock.RUnlock()
+	for _, w := range webhooks {
+		w.publish(m)
+	}
+}
+
+func webhookQueueDepths() []metrics.Sample {
+	webhooksLock.RLock()
+	defer webhooksLock.RUnlock()
+	var samples []metrics.Sample
+	for name, w := range webhooks {
+		samples = append(samples, metrics.Sample{Labels: []string{name}, Value: float64(w.queue.len())})
+	}
+	return samples
+}
+
+func sameWebhookConf(a, b config.WebhookConf) bool {
+	if exprString(a.Filter) != exprString(b.Filter) {
+		return false
+	}
+	a.Filter, b.Filter = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+func newWebhook(name string, wc config.WebhookConf) *Webhook {
+	w := &Webhook{name: name, config: wc, wait: new(sync.WaitGroup)}
+	tlsConfig, err := newTLSConfig(wc.TLS)
+	if err != nil {
+		w.log("tls configuration error: %v", err)
+		return nil
+	}
+	path := wc.Queue.Path
+	if len(path) == 0 {
+		path = "webhook-" + name
+	}
+	if !filepath.IsAbs(path) {
+		path = appPath(path)
+	}
+	w.queue, err = newRetryQueue(path, wc.Queue.Size)
+	if err != nil {
+		w.log("error opening queue: %v", err)
+		return nil
+	}
+	w.client = &http.Client{
+		Timeout: time.Duration(wc.Timeout) * time.Second,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: wc.Concurrency,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	return w
+}
+
+func (w *Webhook) log(f string, v ...interface{}) {
+	log.Printf("[webhook."+w.name+"] "+f, v...)
+}
+
+func (w *Webhook) start() {
+	if n := w.queue.len(); n > 0 {
+		w.log("%d queued events pending", n)
+	}
+	w.wait.Add(1)
+	go w.writer()
+	for i := 0; i < w.config.Concurrency; i++ {
+		w.wait.Add(1)
+		go w.worker()
+	}
+}
+
+func (w *Webhook) stop() {
+	w.log("stopping")
+	w.cancel()
+	w.wait.Wait()
+	if err := w.queue.persist(); err != nil {
+		w.log("queue error: %v", err)
+	}
+	w.client.CloseIdleConnections()
+	w.log("stopped")
+}
+
+// writer keeps the queue files up to date, off the remote event loops.
+func (w *Webhook) writer() {
+	defer w.wait.Done()
+	for {
+		select {
+		case <-w.queue.flush:
+			if err := w.queue.persist(); err != nil {
+				w.log("queue error: %v", err)
+			}
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Webhook) publish(m *ws.Message) {
+	if len(w.config.Remotes) > 0 && !w.config.Remotes[m.Remote] {
+		return
+	}
+	if w.config.Filter != nil && !w.config.Filter.Match(m) {
+		return
+	}
+	if dropped := w.queue.push(m.Remote, m.Data); dropped > 0 {
+		w.log("queue full, dropped %d oldest events", dropped)
+		webhookDeliveries.Add(float64(dropped), w.name, "dropped")
+	}
+}
+
+func (w *Webhook) backoff(attempts int) time.Duration {
+	d := time.Duration(w.config.Retry.Initial) * time.Second
+	max := time.Duration(w.config.Retry.Max) * time.Second
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+func (w *Webhook) worker() {
+	defer w.wait.Done()
+	for {
+		item, wait := w.queue.next()
+		if item == nil {
+			select {
+			case <-w.queue.wake:
+			case <-time.After(wait):
+			case <-w.ctx.Done():
+				return
+			}
+			continue
+		}
+		retry, err := w.deliver(item)
+		if w.ctx.Err() != nil {
+			w.queue.release(item)
+			return
+		}
+		if err == nil {
+			webhookDeliveries.Inc(w.name, "delivered")
+			w.queue.done(item)
+			continue
+		}
+		attempts := item.Attempts + 1
+		if !retry || (w.config.Retry.Attempts > 0 && attempts >= w.config.Retry.Attempts) {
+			w.log("delivery failed after %d attempts, dropping event: %v", attempts, err)
+			webhookDeliveries.Inc(w.name, "failed")
+			w.queue.done(item)
+			continue
+		}
+		delay := w.backoff(attempts)
+		w.log("delivery failed: %v, retry in %v", err, delay)
+		webhookDeliveries.Inc(w.name, "retry")
+		w.queue.retry(item, delay)
+	}
+}
+
+// sign returns the HMAC of "<timestamp>.<body>", so a captured request
+// cannot be replayed with a new timestamp.
+func (w *Webhook) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.config.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts the event and reports whether a failure may be retried.
+func (w *Webhook) deliver(item *queueItem) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.config.Url, bytes.NewReader(item.Data))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(w.ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bs2-evt-filter")
+	req.Header.Set("X-BS2-Remote", item.Remote)
+	if len(w.config.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(w.config.Header, w.sign(timestamp, item.Data))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status: %s", resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return true, err
+	}
+	return false, err
+}